@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const environAdminTokenName = "K3D_REGISTRY_ADMIN_TOKEN"
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, value any) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(append(content, '\n'))
+}
+
+func writeAdminError(w http.ResponseWriter, statusCode int, err error) {
+	writeAdminJSON(w, statusCode, adminError{err.Error()})
+}
+
+// RequireAdminToken returns an http.Handler which only calls inner if the request
+// has the admin token.
+func RequireAdminToken(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the token has to be sent as "Authorization: Bearer <token>"
+		adminToken := currentConfig().AdminToken
+		if adminToken == "" {
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("the admin API is disabled, set -admin-token or %s to enable it", environAdminTokenName))
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k3d-registry-dockerd admin"`)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("missing or incorrect admin token"))
+			return
+		}
+		inner.ServeHTTP(w, req)
+	})
+}
+
+// handleAdminImages lists every cached image.
+func handleAdminImages(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	images, err := ListCachedImages()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if images == nil {
+		images = []CachedImage{}
+	}
+	writeAdminJSON(w, http.StatusOK, images)
+}
+
+// handleAdminImage shows or purges a single cached image repository.
+func handleAdminImage(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	exists, err := fileExists(cachedImageDirectory(name))
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("image %s isn't cached", name))
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		image, err := ReadCachedImage(name)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, image)
+	case "DELETE":
+		_, err := PurgeCachedImage(req.Context(), name)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		slog.InfoContext(req.Context(), "Purged image from cache", "image", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+type adminTag struct {
+	Image     string       `json:"image"`
+	Tag       string       `json:"tag"`
+	Manifests []CachedBlob `json:"manifests"`
+}
+
+// handleAdminTag inspects or purges a cached tag or digest.
+func handleAdminTag(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	tag := req.PathValue("tag")
+
+	switch req.Method {
+	case "GET":
+		manifests, err := InspectCachedReference(name, tag)
+		if errors.Is(err, os.ErrNotExist) {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("%s isn't cached", dockerImageReference(name, tag)))
+			return
+		}
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, adminTag{name, tag, manifests})
+	case "DELETE":
+		removed, err := PurgeCachedReference(req.Context(), name, tag)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !removed {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("%s isn't cached", dockerImageReference(name, tag)))
+			return
+		}
+		slog.InfoContext(req.Context(), "Purged tag from cache", "image", name, "reference", tag)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+// handleAdminTagExport exports a tag or digest from Docker again, whether or not
+// it's already cached.
+func handleAdminTagExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	name := req.PathValue("name")
+	tag := req.PathValue("tag")
+	ctx := WithLogAttrs(req.Context(), "image", name, "reference", tag)
+
+	found, err := ReexportCachedReference(ctx, name, tag)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("couldn't find Docker image %s", dockerImageReference(name, tag)))
+		return
+	}
+	manifests, err := InspectCachedReference(name, tag)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, adminTag{name, tag, manifests})
+}
+
+// handleAdminGC garbage collects blobs that no cached tag references.
+func handleAdminGC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	result, err := GarbageCollectCache(req.Context(), gcMinBlobAge)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.InfoContext(req.Context(), "Garbage collected cache", "removed_blobs", result.RemovedBlobs, "removed_bytes", result.RemovedBytes, "removed_images", result.RemovedImages)
+	writeAdminJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+)
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeRegistryError responds with an error in the format of the distribution
+// API, which clients like Docker show to users.
+func writeRegistryError(w http.ResponseWriter, statusCode int, code, message string) {
+	content, err := json.Marshal(struct {
+		Errors []registryError `json:"errors"`
+	}{[]registryError{{code, message}}})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(append(content, '\n'))
+}
+
+// registryAuthEnabled reports whether clients have to authenticate with this
+// registry, rather than passing their credentials on to upstream registries.
+func (cfg *Config) registryAuthEnabled() bool {
+	return cfg.htpasswd != nil || cfg.TokenAuth
+}
+
+func checkHtpasswd(cfg *Config, username, password string) bool {
+	hash, ok := cfg.htpasswd[username]
+	return ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// requiredAction is the action a request needs to be allowed on its repository.
+func requiredAction(req *http.Request) string {
+	switch req.Method {
+	case "GET", "HEAD":
+		return "pull"
+	case "DELETE":
+		return "delete"
+	default:
+		return "push"
+	}
+}
+
+// RequireRegistryAuth returns an http.Handler which only calls inner if the
+// request is allowed. With token authentication, the request needs a token from
+// the token service that grants its action on the repository it's for, if any,
+// named as it's cached with the registry it comes from. Otherwise, with an
+// htpasswd file, it needs the credentials of one of its users.
+func RequireRegistryAuth(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := currentConfig()
+		switch {
+		case cfg.TokenAuth:
+			// rules and scopes use the name the image is cached as, so that images
+			// from different registries can't be mixed up
+			repository := ""
+			if req.PathValue("name") != "" {
+				repository, _ = requestImageName(req)
+			}
+			action := requiredAction(req)
+			challenge := fmt.Sprintf("Bearer realm=%q,service=%q", tokenRealm(req), tokenService)
+			if repository != "" {
+				challenge = fmt.Sprintf("%s,scope=%q", challenge, fmt.Sprint("repository:", repository, ":", action))
+			}
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				w.Header().Set("WWW-Authenticate", challenge)
+				writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+				return
+			}
+			claims, err := verifyToken(cfg.tokenKey, token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprint(challenge, `,error="invalid_token"`))
+				writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", err.Error())
+				return
+			}
+			granted := claims.grants(repository, action)
+			if !granted && req.URL.Query().Get("ns") == "" {
+				// clients like the Docker CLI ask for a token for the path they
+				// pulled or pushed, rather than the scope in the challenge
+				granted = claims.grants(req.PathValue("name"), action)
+			}
+			if repository != "" && !granted {
+				w.Header().Set("WWW-Authenticate", fmt.Sprint(challenge, `,error="insufficient_scope"`))
+				writeRegistryError(w, http.StatusUnauthorized, "DENIED", fmt.Sprintf("%s access to %s is denied", action, repository))
+				return
+			}
+		case cfg.htpasswd != nil:
+			username, password, ok := req.BasicAuth()
+			if !ok || !checkHtpasswd(cfg, username, password) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", cfg.HtpasswdRealm))
+				writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+				return
+			}
+		}
+		inner.ServeHTTP(w, req)
+	})
+}
+
+// upstreamAuth returns the credentials to pull an image from domain with. Clients'
+// credentials are passed on, unless they're for this registry's own
+// authentication. Otherwise the proxy credentials are used if they're for this
+// domain, and then any credentials for it in the Docker config.
+func upstreamAuth(req *http.Request, domain string) *ImageAuthConfig {
+	cfg := currentConfig()
+	if username, password, ok := req.BasicAuth(); ok && !cfg.registryAuthEnabled() {
+		return &ImageAuthConfig{
+			Username: username,
+			Password: password,
+		}
+	}
+	return fallbackAuth(req.Context(), domain)
+}
+
+// fallbackAuth returns the registry's own credentials for domain, from the proxy
+// settings or the Docker config, which are used when clients don't send any.
+func fallbackAuth(ctx context.Context, domain string) *ImageAuthConfig {
+	cfg := currentConfig()
+	if cfg.ProxyUsername != "" && (cfg.proxyDomain == "" || cfg.proxyDomain == domain) {
+		return &ImageAuthConfig{
+			Username: cfg.ProxyUsername,
+			Password: cfg.ProxyPassword,
+		}
+	}
+	return dockerConfigAuth(ctx, domain)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// builds tag images several times in quick succession, so wait this long after
+// the last tag before exporting
+const autoExportDelay = time.Second
+
+func matchesAutoExportPatterns(ref string) bool {
+	for _, pattern := range currentConfig().AutoExportPatterns {
+		if pattern.MatchString(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// autoExporter exports images shortly after they're tagged, once for each burst
+// of tag events.
+type autoExporter struct {
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func (exporter *autoExporter) schedule(ctx context.Context, ref, imageName, imageTag string) {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	if timer, ok := exporter.pending[ref]; ok {
+		timer.Reset(autoExportDelay)
+		return
+	}
+	if exporter.pending == nil {
+		exporter.pending = make(map[string]*time.Timer)
+	}
+	exporter.pending[ref] = time.AfterFunc(autoExportDelay, func() {
+		exporter.mu.Lock()
+		delete(exporter.pending, ref)
+		exporter.mu.Unlock()
+
+		ctx := WithLogAttrs(ctx, "image", imageName, "reference", imageTag)
+		ctx, cancel := context.WithTimeout(ctx, currentConfig().PullTimeout)
+		defer cancel()
+		slog.InfoContext(ctx, "Exporting image after it was tagged", "docker_reference", ref)
+		startTime := time.Now()
+		found, err := ReexportCachedReference(ctx, imageName, imageTag)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error exporting tagged image", "error", err)
+		} else if !found {
+			slog.WarnContext(ctx, "Tagged image disappeared before it could be exported")
+		} else {
+			slog.InfoContext(ctx, "Exported tagged image", "duration", time.Since(startTime))
+		}
+	})
+}
+
+// watchDockerImageTags follows Docker's image tag events once Docker is reachable.
+// Tags matching the auto-export patterns are exported into the cache straight
+// away. Other tags which are already cached are removed from the cache, so that
+// the next request exports the new image instead of serving the old one. Tags
+// are watched even without any auto-export patterns, for the sake of the latter.
+func watchDockerImageTags(ctx context.Context, dockerConnected <-chan struct{}) {
+	var exporter autoExporter
+	handleTag := func(ref string) {
+		imageName, imageTag, err := ParseImageReference(ref)
+		if err != nil || imageTag == "" || strings.HasPrefix(imageTag, "sha256:") {
+			return
+		}
+		// a pod may have asked for the image before it was built
+		negativeCache.Forget(imageName, imageTag)
+
+		if matchesAutoExportPatterns(ref) {
+			exporter.schedule(ctx, ref, imageName, imageTag)
+			return
+		}
+		removed, err := PurgeCachedReference(ctx, imageName, imageTag)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error removing retagged image from cache", "image", imageName, "reference", imageTag, "error", err)
+		} else if removed {
+			slog.InfoContext(ctx, "Removed retagged image from cache", "image", imageName, "reference", imageTag)
+		}
+	}
+
+	go func() {
+		select {
+		case <-dockerConnected:
+		case <-ctx.Done():
+			return
+		}
+		delay := time.Second
+		for {
+			slog.InfoContext(ctx, "Watching Docker for tagged images")
+			startTime := time.Now()
+			err := DockerWatchImageTags(ctx, handleTag)
+			if ctx.Err() != nil {
+				return
+			}
+			// start backing off again if the connection was up for a while
+			if time.Since(startTime) > time.Minute {
+				delay = time.Second
+			}
+			slog.WarnContext(ctx, "Stopped watching Docker for tagged images, will try again", "error", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, 30*time.Second)
+		}
+	}()
+}
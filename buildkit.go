@@ -13,7 +13,7 @@ import (
 	"github.com/docker/docker/pkg/jsonmessage"
 	controlapi "github.com/moby/buildkit/api/services/control"
 	buildkitsession "github.com/moby/buildkit/session"
-	"log"
+	"log/slog"
 	"net"
 )
 
@@ -31,7 +31,7 @@ func withBuildkitSession(ctx context.Context, f func(*client.Client, *buildkitse
 		go func() {
 			if err := s.Run(ctx, dialSession); err != nil {
 				// TODO: cancel the context passed to ImageBuild?
-				log.Printf("Error in buildkit session: %w", err)
+				slog.ErrorContext(ctx, "Error in BuildKit session", "error", err)
 			}
 		}()
 		defer s.Close()
@@ -101,15 +101,15 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 			}
 			deleted, err := c.ImageRemove(ctx, imageId, image.RemoveOptions{})
 			if err != nil {
-				log.Printf("Error deleting %s: %s", imageId, err)
+				slog.WarnContext(ctx, "Error deleting temporary image", "image_id", imageId, "error", err)
 				return
 			}
 			for _, d := range deleted {
 				if d.Deleted != "" {
-					log.Printf("Deleted temporary image %s", d.Deleted)
+					slog.DebugContext(ctx, "Deleted temporary image", "image_id", d.Deleted)
 				}
 				if d.Untagged != "" {
-					log.Printf("Untagged %s", d.Untagged)
+					slog.DebugContext(ctx, "Untagged temporary image", "image_id", d.Untagged)
 				}
 			}
 		}()
@@ -127,7 +127,7 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 				var result types.BuildResult
 				err := json.Unmarshal(*msg.Aux, &result)
 				if err != nil {
-					log.Printf("error parsing %q: %s", scanner.Text(), err)
+					slog.DebugContext(ctx, "Error parsing BuildKit result", "line", scanner.Text(), "error", err)
 				} else {
 					imageId = result.ID
 				}
@@ -135,7 +135,7 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 
 			// if not a trace message, just print the original line of text
 			if msg.ID != "moby.buildkit.trace" {
-				log.Printf("%s", scanner.Text())
+				slog.DebugContext(ctx, scanner.Text())
 				continue
 			}
 
@@ -144,13 +144,13 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 			var dt []byte
 			err := json.Unmarshal(*msg.Aux, &dt)
 			if err != nil {
-				log.Printf("%s", err)
+				slog.DebugContext(ctx, "Error parsing BuildKit trace", "error", err)
 				continue
 			}
 			var resp controlapi.StatusResponse
 			err = (&resp).UnmarshalVT(dt)
 			if err != nil {
-				log.Printf("%s", err)
+				slog.DebugContext(ctx, "Error parsing BuildKit trace", "error", err)
 				continue
 			}
 			for _, vertex := range resp.Vertexes {
@@ -160,7 +160,8 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 				}
 				out = fmt.Sprintf("{\"id\":\"moby.buildkit.trace\",\"Vertex\":{%s}}", out)
 				if _, ok := seenMessages[out]; !ok {
-					log.Printf("%s", out)
+					slog.DebugContext(ctx, out)
+					SetJobProgress(ctx, vertex.Name)
 					seenMessages[out] = true
 				}
 			}
@@ -174,15 +175,15 @@ func BuildkitForceDockerPull(ctx context.Context, reference string) error {
 				}
 				out = fmt.Sprintf("{\"id\":\"moby.buildkit.trace\",\"VertexStatus\":{%s}}", out)
 				if _, ok := seenMessages[out]; !ok {
-					log.Printf("%s", out)
+					slog.DebugContext(ctx, out)
 					seenMessages[out] = true
 				}
 			}
 			for _, msg := range resp.Logs {
-				log.Printf("%v", msg)
+				slog.DebugContext(ctx, fmt.Sprint(msg))
 			}
 			for _, warning := range resp.Warnings {
-				log.Printf("%v", warning)
+				slog.DebugContext(ctx, fmt.Sprint(warning))
 			}
 		}
 		return scanner.Err()
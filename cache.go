@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifests can't be bigger than this according to the distribution spec, so any
+// bigger blob must be a layer.
+const maxManifestSize = 4 * 1024 * 1024
+
+// CachedTag is an image tag which has an index in the cache.
+type CachedTag struct {
+	Tag string `json:"tag"`
+	// Digest of the manifest or manifest list that the tag points to
+	Digest string `json:"digest,omitempty"`
+	// Total size of the cached blobs that the tag references
+	Size int64 `json:"size"`
+	// When the tag was exported into the cache
+	Exported time.Time `json:"exported"`
+	// When the tag was last served, or nil if it hasn't been since the server started
+	LastAccess *time.Time `json:"lastAccess,omitempty"`
+}
+
+// CachedImage is an image repository with content in the cache.
+type CachedImage struct {
+	Name string      `json:"name"`
+	Tags []CachedTag `json:"tags"`
+	// Number of blobs cached for the image, including manifests
+	Blobs int `json:"blobs"`
+	// Total size of all of the image's cached blobs
+	Size int64 `json:"size"`
+	// Whether the image needed credentials to pull, so is only served to clients
+	// with credentials for it
+	Private bool `json:"private,omitempty"`
+}
+
+// ListCachedImages reads every image in the cache directory.
+func ListCachedImages() ([]CachedImage, error) {
+	entries, err := os.ReadDir(CACHE_DIRECTORY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []CachedImage
+	for _, entry := range entries {
+		// skip lock files and anything else that isn't an image
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name, err := url.QueryUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		image, err := ReadCachedImage(name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// ReadCachedImage reads the tags and blobs cached for a single image.
+func ReadCachedImage(imageName string) (CachedImage, error) {
+	image := CachedImage{Name: imageName}
+
+	blobSizes, err := cachedBlobSizes(imageName)
+	if err != nil {
+		return image, err
+	}
+	image.Blobs = len(blobSizes)
+	for _, size := range blobSizes {
+		image.Size += size
+	}
+
+	privateReference, err := cachedPrivateReference(imageName)
+	if err != nil {
+		return image, err
+	}
+	image.Private = privateReference != ""
+
+	tags, err := cachedTags(imageName)
+	if err != nil {
+		return image, err
+	}
+	for _, tag := range tags {
+		indexFilename := cachedIndexFilename(imageName, tag)
+		info, err := os.Stat(indexFilename)
+		if err != nil {
+			return image, err
+		}
+		cachedTag := CachedTag{
+			Tag:        tag,
+			Exported:   info.ModTime(),
+			LastAccess: lastAccessTime(imageName, tag),
+		}
+		index, err := ParseIndexFile(indexFilename)
+		if err == nil && len(index.Manifests) > 0 {
+			cachedTag.Digest = index.Manifests[0].Digest.String()
+			var shasums []string
+			for _, m := range index.Manifests {
+				shasums = append(shasums, m.Digest.Encoded())
+			}
+			for shasum := range reachableBlobs(imageName, shasums) {
+				cachedTag.Size += blobSizes[shasum]
+			}
+		}
+		image.Tags = append(image.Tags, cachedTag)
+	}
+	return image, nil
+}
+
+// cachedTags returns the tags which have an index in the cache, in sorted order.
+func cachedTags(imageName string) ([]string, error) {
+	indexFilenames, err := filepath.Glob(fmt.Sprint(cachedImageDirectory(imageName), "/indexes/*/index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, indexFilename := range indexFilenames {
+		tag, err := url.QueryUnescape(filepath.Base(filepath.Dir(indexFilename)))
+		if err != nil {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// cachedBlobSizes returns the size of every blob cached for an image, by SHA256 sum.
+func cachedBlobSizes(imageName string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	entries, err := os.ReadDir(fmt.Sprint(cachedImageDirectory(imageName), "/blobs/sha256"))
+	if errors.Is(err, os.ErrNotExist) {
+		return sizes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || isTempFile(entry.Name()) {
+			continue
+		}
+		sizes[entry.Name()] = info.Size()
+	}
+	return sizes, nil
+}
+
+// reachableBlobs follows manifest lists and manifests from the given SHA256 sums,
+// and returns every SHA256 sum they reference along with the sums themselves. Blobs
+// that are referenced but missing from the cache are included too.
+func reachableBlobs(imageName string, shasums []string) map[string]bool {
+	reachable := map[string]bool{}
+	queue := append([]string{}, shasums...)
+	for len(queue) > 0 {
+		shasum := queue[0]
+		queue = queue[1:]
+		if reachable[shasum] {
+			continue
+		}
+		reachable[shasum] = true
+
+		filename := cachedBlobFilenameForSha256(imageName, shasum)
+		info, err := os.Stat(filename)
+		if err != nil || info.Size() > maxManifestSize {
+			continue
+		}
+		mt, err := ParseMediaTypedFile(filename)
+		if err != nil {
+			continue
+		}
+		if IsIndexType(mt.MediaType) {
+			index, err := ParseIndexFile(filename)
+			if err != nil {
+				continue
+			}
+			for _, m := range index.Manifests {
+				queue = append(queue, m.Digest.Encoded())
+			}
+		} else if IsManifestType(mt.MediaType) {
+			manifest, err := ParseManifestFile(filename)
+			if err != nil {
+				continue
+			}
+			queue = append(queue, manifest.Config.Digest.Encoded())
+			for _, layer := range manifest.Layers {
+				queue = append(queue, layer.Digest.Encoded())
+			}
+		}
+	}
+	return reachable
+}
+
+// when each image reference was last served. this only lives in memory, since
+// writing to the cache on every request isn't worth it.
+var lastAccessTimes sync.Map
+
+func recordAccess(imageName, imageTagOrDigest string) {
+	lastAccessTimes.Store(fmt.Sprint(imageName, " ", imageTagOrDigest), time.Now())
+}
+
+func lastAccessTime(imageName, imageTagOrDigest string) *time.Time {
+	t, ok := lastAccessTimes.Load(fmt.Sprint(imageName, " ", imageTagOrDigest))
+	if !ok {
+		return nil
+	}
+	accessed := t.(time.Time)
+	return &accessed
+}
+
+// CachedBlob is a blob referenced by a cached image, along with the blobs it
+// references in turn if it's a manifest list or manifest.
+type CachedBlob struct {
+	Digest    string            `json:"digest"`
+	MediaType string            `json:"mediaType,omitempty"`
+	Platform  *ocispec.Platform `json:"platform,omitempty"`
+	// Size according to whatever referenced the blob
+	Size int64 `json:"size"`
+	// Whether the blob is in the cache
+	Present    bool         `json:"present"`
+	References []CachedBlob `json:"references,omitempty"`
+}
+
+// InspectCachedReference follows a cached tag or digest to the manifest list,
+// manifests, and blobs it references.
+func InspectCachedReference(imageName, imageTagOrDigest string) ([]CachedBlob, error) {
+	var descriptors []ocispec.Descriptor
+	index, err := ParseIndexFile(cachedIndexFilename(imageName, imageTagOrDigest))
+	if err == nil {
+		descriptors = index.Manifests
+	} else if errors.Is(err, os.ErrNotExist) && strings.HasPrefix(imageTagOrDigest, "sha256:") {
+		// digests exported before they got an index are still served from their blob
+		shasum := strings.TrimPrefix(imageTagOrDigest, "sha256:")
+		info, err := os.Stat(cachedBlobFilenameForSha256(imageName, shasum))
+		if err != nil {
+			return nil, err
+		}
+		descriptors = []ocispec.Descriptor{{Digest: digest.Digest(imageTagOrDigest), Size: info.Size()}}
+	} else {
+		return nil, err
+	}
+
+	var blobs []CachedBlob
+	for _, descriptor := range descriptors {
+		blobs = append(blobs, inspectCachedBlob(imageName, descriptor))
+	}
+	return blobs, nil
+}
+
+func inspectCachedBlob(imageName string, descriptor ocispec.Descriptor) CachedBlob {
+	blob := CachedBlob{
+		Digest:    descriptor.Digest.String(),
+		MediaType: descriptor.MediaType,
+		Platform:  descriptor.Platform,
+		Size:      descriptor.Size,
+	}
+	filename := cachedBlobFilenameForSha256(imageName, descriptor.Digest.Encoded())
+	info, err := os.Stat(filename)
+	if err != nil {
+		return blob
+	}
+	blob.Present = true
+	if info.Size() > maxManifestSize {
+		return blob
+	}
+
+	mt, err := ParseMediaTypedFile(filename)
+	if err != nil {
+		return blob
+	}
+	if IsIndexType(mt.MediaType) {
+		blob.MediaType = mt.MediaType
+		index, err := ParseIndexFile(filename)
+		if err != nil {
+			return blob
+		}
+		for _, m := range index.Manifests {
+			blob.References = append(blob.References, inspectCachedBlob(imageName, m))
+		}
+	} else if IsManifestType(mt.MediaType) {
+		blob.MediaType = mt.MediaType
+		manifest, err := ParseManifestFile(filename)
+		if err != nil {
+			return blob
+		}
+		blob.References = append(blob.References, inspectCachedBlob(imageName, manifest.Config))
+		for _, layer := range manifest.Layers {
+			blob.References = append(blob.References, inspectCachedBlob(imageName, layer))
+		}
+	}
+	return blob
+}
+
+// PurgeCachedReference removes a tag or digest from the cache. The blobs it
+// referenced stay around until the next garbage collection, since other tags may
+// share them.
+func PurgeCachedReference(ctx context.Context, imageName, imageTagOrDigest string) (bool, error) {
+	removed, err := withCacheLock(ctx, imageName, imageTagOrDigest, func() (any, error) {
+		directory := filepath.Dir(cachedIndexFilename(imageName, imageTagOrDigest))
+		exists, err := fileExists(directory)
+		if err != nil || !exists {
+			return false, err
+		}
+		return true, os.RemoveAll(directory)
+	})
+	if err != nil {
+		return false, err
+	}
+	lastAccessTimes.Delete(fmt.Sprint(imageName, " ", imageTagOrDigest))
+	return removed.(bool), nil
+}
+
+// PurgeCachedImage removes an image repository from the cache entirely.
+func PurgeCachedImage(ctx context.Context, imageName string) (bool, error) {
+	removed, err := withImageLock(ctx, imageName, func() (any, error) {
+		directory := cachedImageDirectory(imageName)
+		exists, err := fileExists(directory)
+		if err != nil || !exists {
+			return false, err
+		}
+		return true, os.RemoveAll(directory)
+	})
+	if err != nil {
+		return false, err
+	}
+	return removed.(bool), nil
+}
+
+// ReexportCachedReference exports a tag or digest from Docker again, replacing
+// whatever was cached for it.
+func ReexportCachedReference(ctx context.Context, imageName, imageTagOrDigest string) (bool, error) {
+	found, err := withCacheLock(ctx, imageName, imageTagOrDigest, func() (any, error) {
+		return findAndExportImage(ctx, imageName, imageTagOrDigest, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	return found.(bool), nil
+}
+
+// blobs newer than this are never garbage collected, since they may belong to an
+// export or push that hasn't written its index yet.
+const gcMinBlobAge = time.Hour
+
+// GCResult summarizes what a garbage collection removed.
+type GCResult struct {
+	RemovedBlobs  int   `json:"removedBlobs"`
+	RemovedBytes  int64 `json:"removedBytes"`
+	RemovedImages int   `json:"removedImages"`
+}
+
+// GarbageCollectCache removes blobs which aren't reachable from any cached tag or
+// digest, and images which have nothing left.
+func GarbageCollectCache(ctx context.Context, minBlobAge time.Duration) (GCResult, error) {
+	var result GCResult
+	images, err := ListCachedImages()
+	if err != nil {
+		return result, err
+	}
+	indexed, err := fileExists(digestIndexesFilename())
+	if err != nil {
+		return result, err
+	}
+	for _, image := range images {
+		_, err := withImageLock(ctx, image.Name, func() (any, error) {
+			if !indexed {
+				err := indexUnreferencedManifests(ctx, image.Name)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, garbageCollectImage(ctx, image.Name, minBlobAge, &result)
+		})
+		if err != nil {
+			return result, fmt.Errorf("error collecting %s: %w", image.Name, err)
+		}
+	}
+	if !indexed {
+		_, err = copyToFile(digestIndexesFilename(), strings.NewReader(""))
+	}
+	return result, err
+}
+
+// digestIndexesFilename marks a cache directory whose images referenced by
+// digest all have an index. Older versions didn't write one for them, so the
+// first garbage collection gives them one before collecting anything.
+func digestIndexesFilename() string {
+	return filepath.Join(CACHE_DIRECTORY, ".digest-indexes")
+}
+
+// indexUnreferencedManifests writes an index for each manifest or manifest list
+// that neither a tag nor another manifest list references, which is what older
+// versions left behind for images referenced by digest.
+func indexUnreferencedManifests(ctx context.Context, imageName string) error {
+	refs, err := cachedTags(imageName)
+	if err != nil {
+		return err
+	}
+	var roots []string
+	for _, ref := range refs {
+		index, err := ParseIndexFile(cachedIndexFilename(imageName, ref))
+		if err != nil {
+			// garbage collection skips images with broken indexes anyway
+			return nil
+		}
+		for _, m := range index.Manifests {
+			roots = append(roots, m.Digest.Encoded())
+		}
+	}
+	referenced := reachableBlobs(imageName, roots)
+
+	entries, err := os.ReadDir(fmt.Sprint(cachedImageDirectory(imageName), "/blobs/sha256"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var manifests []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || isTempFile(entry.Name()) || info.Size() > maxManifestSize {
+			continue
+		}
+		mt, err := ParseMediaTypedFile(cachedBlobFilenameForSha256(imageName, entry.Name()))
+		if err != nil || !(IsIndexType(mt.MediaType) || IsManifestType(mt.MediaType)) {
+			continue
+		}
+		manifests = append(manifests, entry.Name())
+		for shasum := range reachableBlobs(imageName, []string{entry.Name()}) {
+			if shasum != entry.Name() {
+				referenced[shasum] = true
+			}
+		}
+	}
+	for _, shasum := range manifests {
+		if referenced[shasum] {
+			continue
+		}
+		_, err := writeManifestIndex(imageName, fmt.Sprint("sha256:", shasum), shasum)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Wrote index for manifest cached by digest", "image", imageName, "digest", fmt.Sprint("sha256:", shasum))
+	}
+	return nil
+}
+
+func garbageCollectImage(ctx context.Context, imageName string, minBlobAge time.Duration, result *GCResult) error {
+	refs, err := cachedTags(imageName)
+	if err != nil {
+		return err
+	}
+	var roots []string
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, "sha256:") {
+			roots = append(roots, strings.TrimPrefix(ref, "sha256:"))
+		}
+		index, err := ParseIndexFile(cachedIndexFilename(imageName, ref))
+		if err != nil {
+			// don't guess what a broken index referenced, just keep everything
+			slog.WarnContext(ctx, "Not collecting image with an unreadable index", "image", imageName, "reference", ref, "error", err)
+			return nil
+		}
+		for _, m := range index.Manifests {
+			roots = append(roots, m.Digest.Encoded())
+		}
+	}
+	reachable := reachableBlobs(imageName, roots)
+
+	entries, err := os.ReadDir(fmt.Sprint(cachedImageDirectory(imageName), "/blobs/sha256"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	remaining := 0
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			// a blob still being written
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if reachable[entry.Name()] || time.Since(info.ModTime()) < minBlobAge {
+			remaining++
+			continue
+		}
+		err = os.Remove(cachedBlobFilenameForSha256(imageName, entry.Name()))
+		if err != nil {
+			return err
+		}
+		slog.DebugContext(ctx, "Removed unreferenced blob", "image", imageName, "file", fmt.Sprint("blobs/sha256/", entry.Name()), "bytes", info.Size())
+		result.RemovedBlobs++
+		result.RemovedBytes += info.Size()
+	}
+
+	if len(refs) == 0 && remaining == 0 {
+		err = os.RemoveAll(cachedImageDirectory(imageName))
+		if err != nil {
+			return err
+		}
+		result.RemovedImages++
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runCacheCommand runs "cache <subcommand>", which works on the cache directory
+// directly so it can be used without the registry running. It takes the same
+// locks as the registry, though, so it's also safe to use while it is.
+func runCacheCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		printCacheUsage()
+		return 2
+	}
+	subcommand, args := args[0], args[1:]
+	switch subcommand {
+	case "ls":
+		return runCacheLs(args)
+	case "inspect":
+		return runCacheInspect(args)
+	case "rm":
+		return runCacheRm(args)
+	case "gc":
+		return runCacheGC(args)
+	case "verify":
+		return runCacheVerify(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown cache command %q\n\n", subcommand)
+		printCacheUsage()
+		return 2
+	}
+}
+
+func printCacheUsage() {
+	fmt.Fprint(os.Stderr, `Usage: k3d-registry-dockerd cache <command> [flags] [args]
+
+Commands:
+  ls                List cached images and tags
+  inspect <ref>     Show what a cached image or tag references
+  rm <ref>...       Remove cached tags, or whole images if no tag is given
+  gc                Remove blobs which no cached tag references
+  verify            Check cached blobs for corruption and tags for missing blobs
+
+Images are referenced like "nginx", "nginx:latest", or "ghcr.io/org/app@sha256:...".
+`)
+}
+
+func newCacheFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(fmt.Sprint("cache ", name), flag.ExitOnError)
+	flags.StringVar(&CACHE_DIRECTORY, "cache-dir", CACHE_DIRECTORY, "Cache directory to work on")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: k3d-registry-dockerd cache %s [flags] %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseCachedReference splits an image reference given on the command line into
+// the image name and tag or digest used in the cache, which may be empty. Images
+// pulled through the registry are cached under their full name including the
+// domain, but pushed images aren't, so the name is only normalized (like Docker
+// does, so "nginx" is "docker.io/library/nginx") if it isn't cached as given.
+func parseCachedReference(ref string) (string, string, error) {
+	name, tagOrDigest, found := strings.Cut(ref, "@")
+	if !found {
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			name, tagOrDigest = ref[:i], ref[i+1:]
+		}
+	}
+	if name == "" || strings.HasPrefix(name, ".") || (found && !strings.HasPrefix(tagOrDigest, "sha256:")) {
+		return "", "", fmt.Errorf("invalid image reference %q", ref)
+	}
+
+	exists, err := fileExists(cachedImageDirectory(name))
+	if err != nil || exists {
+		return name, tagOrDigest, err
+	}
+	return ParseImageReference(ref)
+}
+
+func runCacheLs(args []string) int {
+	flags := newCacheFlagSet("ls", "")
+	asJSON := flags.Bool("json", false, "Output JSON")
+	flags.Parse(args)
+
+	images, err := ListCachedImages()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		if images == nil {
+			images = []CachedImage{}
+		}
+		return printJSON(images)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAG\tDIGEST\tSIZE\tEXPORTED")
+	for _, image := range images {
+		if len(image.Tags) == 0 {
+			fmt.Fprintf(w, "%s\t<none>\t\t%s\t\n", image.Name, formatBytes(image.Size))
+		}
+		for _, tag := range image.Tags {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", image.Name, tag.Tag, tag.Digest, formatBytes(tag.Size), formatAgo(tag.Exported))
+		}
+	}
+	w.Flush()
+	return 0
+}
+
+func runCacheInspect(args []string) int {
+	flags := newCacheFlagSet("inspect", "<ref>")
+	asJSON := flags.Bool("json", false, "Output JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	name, tagOrDigest, err := parseCachedReference(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if tagOrDigest == "" {
+		exists, err := fileExists(cachedImageDirectory(name))
+		if err == nil && !exists {
+			err = fmt.Errorf("image %s isn't cached", name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		image, err := ReadCachedImage(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJSON {
+			return printJSON(image)
+		}
+		fmt.Printf("%s (%d blobs, %s)\n", image.Name, image.Blobs, formatBytes(image.Size))
+		for _, tag := range image.Tags {
+			fmt.Printf("  %s -> %s (%s, exported %s)\n", tag.Tag, tag.Digest, formatBytes(tag.Size), formatAgo(tag.Exported))
+		}
+		return 0
+	}
+
+	manifests, err := InspectCachedReference(name, tagOrDigest)
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("%s isn't cached", dockerImageReference(name, tagOrDigest))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		return printJSON(adminTag{name, tagOrDigest, manifests})
+	}
+	fmt.Println(dockerImageReference(name, tagOrDigest))
+	for _, manifest := range manifests {
+		printCachedBlob(os.Stdout, manifest, "  ")
+	}
+	return 0
+}
+
+func printCachedBlob(w io.Writer, blob CachedBlob, indent string) {
+	var details []string
+	if blob.MediaType != "" {
+		details = append(details, blob.MediaType)
+	}
+	if blob.Platform != nil {
+		platform := fmt.Sprint(blob.Platform.OS, "/", blob.Platform.Architecture)
+		if blob.Platform.Variant != "" {
+			platform = fmt.Sprint(platform, "/", blob.Platform.Variant)
+		}
+		details = append(details, platform)
+	}
+	details = append(details, formatBytes(blob.Size))
+	if !blob.Present {
+		details = append(details, "MISSING")
+	}
+	fmt.Fprintf(w, "%s%s (%s)\n", indent, blob.Digest, strings.Join(details, ", "))
+	for _, reference := range blob.References {
+		printCachedBlob(w, reference, fmt.Sprint(indent, "  "))
+	}
+}
+
+func runCacheRm(args []string) int {
+	flags := newCacheFlagSet("rm", "<ref>...")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx := context.Background()
+	status := 0
+	for _, ref := range flags.Args() {
+		name, tagOrDigest, err := parseCachedReference(ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		var removed bool
+		if tagOrDigest == "" {
+			removed, err = PurgeCachedImage(ctx, name)
+		} else {
+			removed, err = PurgeCachedReference(ctx, name, tagOrDigest)
+			name = dockerImageReference(name, tagOrDigest)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error removing %s: %s\n", name, err)
+			status = 1
+		} else if !removed {
+			fmt.Fprintf(os.Stderr, "%s isn't cached\n", name)
+			status = 1
+		} else {
+			fmt.Println("Removed", name)
+		}
+	}
+	return status
+}
+
+func runCacheGC(args []string) int {
+	flags := newCacheFlagSet("gc", "")
+	minAge := flags.Duration("min-age", gcMinBlobAge, "Keep unreferenced blobs newer than this, since they may belong to an export or push in progress")
+	flags.Parse(args)
+
+	result, err := GarbageCollectCache(context.Background(), *minAge)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Removed %d blobs (%s) and %d empty images\n", result.RemovedBlobs, formatBytes(result.RemovedBytes), result.RemovedImages)
+	return 0
+}
+
+func runCacheVerify(args []string) int {
+	flags := newCacheFlagSet("verify", "[<image>...]")
+	fix := flags.Bool("fix", false, "Remove corrupted blobs along with anything referencing them, and tags with missing blobs, so they're exported again when next requested")
+	flags.Parse(args)
+
+	var names []string
+	for _, ref := range flags.Args() {
+		name, _, err := parseCachedReference(ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		images, err := ListCachedImages()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, image := range images {
+			names = append(names, image.Name)
+		}
+	}
+
+	ctx := context.Background()
+	problems := 0
+	for _, name := range names {
+		n, err := verifyCachedImage(ctx, name, *fix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error verifying %s: %s\n", name, err)
+			return 1
+		}
+		problems += n
+	}
+	if problems > 0 && !*fix {
+		fmt.Printf("Found %d problems, run with -fix to remove the affected content\n", problems)
+		return 1
+	}
+	fmt.Printf("Verified %d images\n", len(names))
+	return 0
+}
+
+// verifyCachedImage checks that every blob of an image matches its digest, and
+// that every tag's blobs are all cached. It returns the number of problems found.
+func verifyCachedImage(ctx context.Context, imageName string, fix bool) (int, error) {
+	problems := 0
+
+	blobSizes, err := cachedBlobSizes(imageName)
+	if err != nil {
+		return 0, err
+	}
+	for shasum := range blobSizes {
+		actual, err := hashFile(cachedBlobFilenameForSha256(imageName, shasum))
+		if errors.Is(err, os.ErrNotExist) {
+			// removed along with another corrupted blob
+			continue
+		}
+		if err != nil {
+			return problems, err
+		}
+		if actual == shasum {
+			continue
+		}
+		problems++
+		fmt.Printf("%s: blob sha256:%s is corrupted, its content has digest sha256:%s\n", imageName, shasum, actual)
+		if fix {
+			_, err := withImageLock(ctx, imageName, func() (any, error) {
+				return nil, removeBlobAndReferences(ctx, imageName, shasum)
+			})
+			if err != nil {
+				return problems, err
+			}
+			fmt.Printf("%s: removed blob sha256:%s and everything referencing it\n", imageName, shasum)
+		}
+	}
+
+	refs, err := cachedTags(imageName)
+	if err != nil {
+		return problems, err
+	}
+	for _, ref := range refs {
+		manifests, err := InspectCachedReference(imageName, ref)
+		if err != nil {
+			return problems, err
+		}
+		var missing []string
+		for _, manifest := range manifests {
+			missing = append(missing, missingBlobs(manifest)...)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		problems++
+		fmt.Printf("%s: missing blobs %s\n", dockerImageReference(imageName, ref), strings.Join(missing, ", "))
+		if fix {
+			_, err := PurgeCachedReference(ctx, imageName, ref)
+			if err != nil {
+				return problems, err
+			}
+			fmt.Printf("%s: removed\n", dockerImageReference(imageName, ref))
+		}
+	}
+	return problems, nil
+}
+
+// missingBlobs lists the blobs that a cached manifest references but aren't
+// cached. Like checkManifestAndReferencedBlobsExist, only manifests have to be
+// complete: Docker only exports the manifests for its own platform, so the other
+// manifests in a manifest list are allowed to be missing.
+func missingBlobs(blob CachedBlob) []string {
+	if !blob.Present {
+		return []string{blob.Digest}
+	}
+	var missing []string
+	for _, reference := range blob.References {
+		if IsIndexType(blob.MediaType) && !reference.Present {
+			continue
+		}
+		missing = append(missing, missingBlobs(reference)...)
+	}
+	return missing
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func printJSON(value any) int {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(content))
+	return 0
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings of the registry, which come from command line flags
+// and the config file. Settings are read with currentConfig, and may change while
+// running if the config file is reloaded.
+type Config struct {
+	Addr               string
+	CacheDir           string
+	VerifyBlobs        bool
+	PullTimeout        time.Duration
+	TagPolicies        TagPolicies
+	NegativeCacheTTL   time.Duration
+	LogLevel           slog.Level
+	LogFormat          string
+	MinFreeDiskBytes   uint64
+	AdminToken         string
+	WarmImages         []string
+	WarmConcurrency    int
+	ExportLocalImages  bool
+	LocalImagesFilter  []*regexp.Regexp
+	AutoExportPatterns []*regexp.Regexp
+	OTLPEndpoint       string
+	TLSCertificate     string
+	TLSKey             string
+	TLSGenerate        bool
+	TLSHosts           []string
+	HtpasswdPath       string
+	HtpasswdRealm      string
+	TokenAuth          bool
+	TokenSecret        string
+	AccessRules        AccessRules
+	DeleteEnabled      bool
+	ProxyRemoteURL     string
+	ProxyUsername      string
+	ProxyPassword      string
+	DockerConfig       string
+	ShutdownTimeout    time.Duration
+
+	// worked out from the settings above by LoadConfig
+	htpasswd    map[string][]byte
+	tokenKey    []byte
+	proxyDomain string
+	warnings    []string
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		CacheDir:         "cache",
+		PullTimeout:      30 * time.Minute,
+		NegativeCacheTTL: 30 * time.Second,
+		LogLevel:         slog.LevelInfo,
+		LogFormat:        "text",
+		MinFreeDiskBytes: 512 * 1024 * 1024,
+		WarmConcurrency:  4,
+		HtpasswdRealm:    "k3d-registry-dockerd",
+		ShutdownTimeout:  8 * time.Second,
+	}
+}
+
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the settings in effect. The result must not be modified,
+// and may be replaced at any time, so anything that needs a setting to stay the
+// same for a while should keep its own copy.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// the minimum level of log messages, which can change when reloading the config
+var logLevel slog.LevelVar
+
+// registerFlags defines the command line flags for each setting in cfg. The
+// config file uses the same names.
+func (cfg *Config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&cfg.Addr, "addr", cfg.Addr, fmt.Sprintf("Address to listen on (default %q, or value of environment variable %s)", defaultAddr, environAddrName))
+	flags.StringVar(&cfg.CacheDir, "cache-dir", cfg.CacheDir, "Directory to cache exported images in")
+	flags.BoolVar(&cfg.VerifyBlobs, "verify-blobs", cfg.VerifyBlobs, "Check the digest of cached blobs while serving them, and remove corrupted blobs from the cache")
+	flags.DurationVar(&cfg.PullTimeout, "pull-timeout", cfg.PullTimeout, "Maximum time to spend pulling and exporting a single image, independent of how long clients wait")
+	flags.Var(&cfg.TagPolicies, "tag-policy", "Revalidation policy for cached tags, as `pattern=policy` where policy is \"immutable\", \"always\", or a duration like \"10m\". Patterns match domain/name:tag, and \"*\" matches anything. May be given multiple times, and the first matching pattern wins (default immutable)")
+	flags.DurationVar(&cfg.NegativeCacheTTL, "negative-cache-ttl", cfg.NegativeCacheTTL, "How long to remember that an image wasn't found or required authorization before asking Docker again (0 to disable)")
+	flags.TextVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Minimum level of log messages to output: debug, info, warn, or error")
+	flags.Func("log-format", fmt.Sprintf("Format of log messages: text or json (default %q)", cfg.LogFormat), func(value string) error {
+		if value != "text" && value != "json" {
+			return fmt.Errorf("unknown log format %q", value)
+		}
+		cfg.LogFormat = value
+		return nil
+	})
+	flags.Func("min-free-disk-mb", fmt.Sprintf("Minimum free disk space for the cache, in MiB, below which /readyz reports not ready (default %d)", cfg.MinFreeDiskBytes/1024/1024), func(value string) error {
+		mb, err := strconv.ParseUint(value, 10, 64)
+		cfg.MinFreeDiskBytes = mb * 1024 * 1024
+		return err
+	})
+	flags.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, fmt.Sprintf("Token required to use the admin API under /admin/ (default taken from environment variable %s, or disabled)", environAdminTokenName))
+	flags.Func("warm-images", fmt.Sprintf("Comma-separated `images` to prefetch into the cache at startup. May be given multiple times (default taken from environment variable %s)", environWarmImagesName), func(value string) error {
+		cfg.WarmImages = append(cfg.WarmImages, parseImageList(value)...)
+		return nil
+	})
+	flags.IntVar(&cfg.WarmConcurrency, "warm-concurrency", cfg.WarmConcurrency, "Number of warm or local images to pull and export at once")
+	flags.BoolVar(&cfg.ExportLocalImages, "export-local-images", cfg.ExportLocalImages, "Export every tagged local Docker image into the cache at startup, in the background")
+	flags.Func("local-images-filter", "Only export local images matching one of these comma-separated `patterns`, like \"myorg/*\" or \"*:dev\", where \"*\" matches anything. May be given multiple times", func(value string) error {
+		for _, pattern := range parseImageList(value) {
+			cfg.LocalImagesFilter = append(cfg.LocalImagesFilter, globRegexp(pattern))
+		}
+		return nil
+	})
+	flags.Func("auto-export", "Export local images matching these comma-separated `patterns`, like \"myorg/*\" or \"*:dev\", into the cache as soon as they're built or tagged. Other cached images are removed from the cache when they're tagged again. May be given multiple times", func(value string) error {
+		for _, pattern := range parseImageList(value) {
+			cfg.AutoExportPatterns = append(cfg.AutoExportPatterns, globRegexp(pattern))
+		}
+		return nil
+	})
+	flags.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "URL of an OTLP/HTTP collector to send traces to, like \"http://localhost:4318\" (default taken from OTEL_EXPORTER_OTLP_ENDPOINT, or disabled)")
+	flags.StringVar(&cfg.TLSCertificate, "tls-cert", cfg.TLSCertificate, "PEM `file` with the certificate to serve HTTPS with, which requires -tls-key")
+	flags.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "PEM `file` with the private key of -tls-cert")
+	flags.BoolVar(&cfg.TLSGenerate, "tls-generate", cfg.TLSGenerate, "Serve HTTPS with a certificate signed by a self-signed CA, both generated on first start and kept in the cache directory under .tls/")
+	flags.Func("tls-hosts", "Comma-separated `names` and IP addresses the generated certificate is valid for, in addition to localhost and the hostname. May be given multiple times", func(value string) error {
+		cfg.TLSHosts = append(cfg.TLSHosts, parseImageList(value)...)
+		return nil
+	})
+	flags.StringVar(&cfg.HtpasswdPath, "htpasswd", cfg.HtpasswdPath, "htpasswd `file` of users allowed to use the registry, with bcrypt passwords (htpasswd -B). Clients' credentials are then no longer passed on to upstream registries")
+	flags.StringVar(&cfg.HtpasswdRealm, "htpasswd-realm", cfg.HtpasswdRealm, "Realm sent to clients which haven't authenticated with -htpasswd")
+	flags.BoolVar(&cfg.TokenAuth, "token-auth", cfg.TokenAuth, "Require clients to get a token from the token service at /token, logging in with a user from -htpasswd or anonymously, which grants the actions allowed by -access")
+	flags.StringVar(&cfg.TokenSecret, "token-secret", cfg.TokenSecret, "Secret to sign tokens with (default generated and kept in the cache directory)")
+	flags.Var(&cfg.AccessRules, "access", "Access rule for -token-auth, as `user:pattern=actions` where user is a user from -htpasswd, \"*\" for any of them, or \"anonymous\", pattern matches repository names with \"*\" matching anything, and actions are pull, push, delete, or *. May be given multiple times, and the first matching rule wins (default every user can do anything, and anonymous clients nothing)")
+	flags.BoolVar(&cfg.DeleteEnabled, "delete-enabled", cfg.DeleteEnabled, "Allow clients to delete manifests, tags, and blobs from the cache")
+	flags.StringVar(&cfg.ProxyRemoteURL, "proxy-remote-url", cfg.ProxyRemoteURL, "URL of the registry to pull images from when a request doesn't say which, like \"https://registry-1.docker.io\". \"*\" pulls from whichever registry each request names, which is the default")
+	flags.StringVar(&cfg.ProxyUsername, "proxy-username", cfg.ProxyUsername, "Username to pull from -proxy-remote-url with, or from every registry if it's \"*\", when a request has no credentials of its own")
+	flags.StringVar(&cfg.ProxyPassword, "proxy-password", cfg.ProxyPassword, "Password of -proxy-username")
+	flags.StringVar(&cfg.DockerConfig, "docker-config", cfg.DockerConfig, "Docker config.json `file`, or the directory containing it, to use credentials from when pulling for clients which don't send any, including from credential helpers (credsStore and credHelpers)")
+	flags.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long to wait for requests and exports in progress to finish after SIGTERM or SIGINT before cancelling them. Docker kills containers 10s after stopping them, unless given a longer timeout")
+}
+
+// clearList empties the setting of a flag which can be given multiple times, so
+// that giving it on the command line replaces the config file's list instead of
+// adding to it.
+func (cfg *Config) clearList(name string) {
+	switch name {
+	case "tag-policy":
+		cfg.TagPolicies = nil
+	case "warm-images":
+		cfg.WarmImages = nil
+	case "local-images-filter":
+		cfg.LocalImagesFilter = nil
+	case "auto-export":
+		cfg.AutoExportPatterns = nil
+	case "tls-hosts":
+		cfg.TLSHosts = nil
+	case "access":
+		cfg.AccessRules = nil
+	}
+}
+
+const environConfigName = "K3D_REGISTRY_CONFIG"
+
+func registerConfigFlag(flags *flag.FlagSet, configPath *string) {
+	flags.StringVar(configPath, "config", os.Getenv(environConfigName), fmt.Sprintf("YAML `file` with settings named like these flags, which is reloaded on SIGHUP or when it changes. Flags given on the command line take precedence (default taken from environment variable %s)", environConfigName))
+}
+
+// LoadConfig reads the official registry's config.yml and REGISTRY_* environment
+// variables, then the config file, and then the command line arguments, each on
+// top of the last. Either config file may be empty to skip it.
+func LoadConfig(configPath, distributionConfigPath string, args []string) (*Config, error) {
+	cfg := defaultConfig()
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	cfg.registerFlags(flags)
+	var ignored string
+	registerConfigFlag(flags, &ignored)
+
+	if distributionConfigPath != "" {
+		warnings, err := applyDistributionConfig(flags, distributionConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.warnings = append(cfg.warnings, warnings...)
+	}
+	warnings, err := applyDistributionEnv(flags)
+	if err != nil {
+		return nil, err
+	}
+	cfg.warnings = append(cfg.warnings, warnings...)
+	if configPath != "" {
+		err := applyConfigFile(flags, configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// find out which flags are on the command line first, so that their lists
+	// replace the config files' ones
+	commandLine := flag.NewFlagSet("serve", flag.ContinueOnError)
+	commandLine.SetOutput(io.Discard)
+	defaultConfig().registerFlags(commandLine)
+	registerConfigFlag(commandLine, &ignored)
+	err = commandLine.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	commandLine.Visit(func(f *flag.Flag) {
+		cfg.clearList(f.Name)
+	})
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if (cfg.TLSCertificate == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if cfg.TLSGenerate && cfg.TLSCertificate != "" {
+		return nil, fmt.Errorf("tls-generate can't be used with tls-cert")
+	}
+	if cfg.HtpasswdPath != "" {
+		users, warnings, err := loadHtpasswd(cfg.HtpasswdPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.htpasswd = users
+		cfg.warnings = append(cfg.warnings, warnings...)
+	}
+	if cfg.TokenAuth && cfg.TokenSecret != "" {
+		cfg.tokenKey = []byte(cfg.TokenSecret)
+	} else if cfg.TokenAuth {
+		cfg.tokenKey, err = loadOrCreateTokenKey(cfg.CacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("error loading token key: %w", err)
+		}
+	}
+	cfg.proxyDomain, err = proxyDomain(cfg.ProxyRemoteURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy-remote-url: %w", err)
+	}
+
+	if len(cfg.WarmImages) == 0 {
+		cfg.WarmImages = parseImageList(os.Getenv(environWarmImagesName))
+	}
+	// not the flag's default, so that it isn't printed with the usage
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = os.Getenv(environAdminTokenName)
+	}
+	if cfg.WarmConcurrency < 1 {
+		return nil, fmt.Errorf("warm-concurrency must be at least 1")
+	}
+	return cfg, nil
+}
+
+// applyConfigFile sets flags from a YAML config file, which is a mapping from flag
+// names to values. Flags which can be given multiple times take a list.
+func applyConfigFile(flags *flag.FlagSet, configPath string) error {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if len(document.Content) == 0 {
+		// empty file
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: config should be a mapping of setting names to values", configPath, root.Line)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if flags.Lookup(key.Value) == nil || key.Value == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", configPath, key.Line, key.Value)
+		}
+		var values []*yaml.Node
+		switch value.Kind {
+		case yaml.ScalarNode:
+			values = []*yaml.Node{value}
+		case yaml.SequenceNode:
+			values = value.Content
+		default:
+			return fmt.Errorf("%s:%d: %s should be a value or a list of values", configPath, value.Line, key.Value)
+		}
+		for _, v := range values {
+			if v.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s:%d: %s should be a value or a list of values", configPath, v.Line, key.Value)
+			}
+			err := flags.Set(key.Value, v.Value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %w", configPath, v.Line, v.Value, key.Value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// settingsRequiringRestart lists the settings which differ between two configs but
+// only take effect at startup.
+func settingsRequiringRestart(old, new *Config) []string {
+	var names []string
+	if old.Addr != new.Addr {
+		names = append(names, "addr")
+	}
+	if old.CacheDir != new.CacheDir {
+		names = append(names, "cache-dir")
+	}
+	if old.LogFormat != new.LogFormat {
+		names = append(names, "log-format")
+	}
+	if !slices.Equal(old.WarmImages, new.WarmImages) || old.WarmConcurrency != new.WarmConcurrency {
+		names = append(names, "warm-images")
+	}
+	if old.ExportLocalImages != new.ExportLocalImages || len(old.LocalImagesFilter) != len(new.LocalImagesFilter) {
+		names = append(names, "export-local-images")
+	}
+	if (len(old.AutoExportPatterns) == 0) != (len(new.AutoExportPatterns) == 0) {
+		names = append(names, "auto-export")
+	}
+	if old.OTLPEndpoint != new.OTLPEndpoint {
+		names = append(names, "otlp-endpoint")
+	}
+	if old.TLSCertificate != new.TLSCertificate || old.TLSKey != new.TLSKey {
+		names = append(names, "tls-cert")
+	}
+	if old.TLSGenerate != new.TLSGenerate || !slices.Equal(old.TLSHosts, new.TLSHosts) {
+		names = append(names, "tls-generate")
+	}
+	return names
+}
+
+// how often to check whether the config file has changed
+const configPollInterval = 2 * time.Second
+
+// watchConfigFile reloads the config files when the process gets SIGHUP or one
+// of them changes. Pulls and exports already in progress keep the settings they
+// started with. If the new config is invalid, the old one stays in effect.
+func watchConfigFile(ctx context.Context, configPath, distributionConfigPath string, args []string) {
+	var paths []string
+	for _, path := range []string{distributionConfigPath, configPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	lastModified := func() []time.Time {
+		var times []time.Time
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				times = append(times, time.Time{})
+			} else {
+				times = append(times, info.ModTime())
+			}
+		}
+		return times
+	}
+	modified := lastModified()
+
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				slog.InfoContext(ctx, "Reloading config after SIGHUP", "config", paths)
+			case <-ticker.C:
+				m := lastModified()
+				if slices.EqualFunc(m, modified, time.Time.Equal) {
+					continue
+				}
+				modified = m
+				slog.InfoContext(ctx, "Reloading config after it changed", "config", paths)
+			case <-ctx.Done():
+				return
+			}
+			reloadConfig(ctx, configPath, distributionConfigPath, args)
+		}
+	}()
+}
+
+func reloadConfig(ctx context.Context, configPath, distributionConfigPath string, args []string) {
+	cfg, err := LoadConfig(configPath, distributionConfigPath, args)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.WarnContext(ctx, "Config file is missing, keeping the current config", "error", err)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reloading config, keeping the current config", "error", err)
+		return
+	}
+	old := currentConfig()
+	if names := settingsRequiringRestart(old, cfg); len(names) > 0 {
+		slog.WarnContext(ctx, "Some changed settings only take effect after a restart", "settings", names)
+	}
+	activeConfig.Store(cfg)
+	logLevel.Set(cfg.LogLevel)
+	logConfig(ctx, cfg)
+	slog.InfoContext(ctx, "Reloaded config")
+}
+
+// logConfig logs the notable settings in effect.
+func logConfig(ctx context.Context, cfg *Config) {
+	if cfg.VerifyBlobs {
+		slog.InfoContext(ctx, "Verifying blob digests while serving")
+	}
+	if cfg.AdminToken != "" {
+		slog.InfoContext(ctx, "Enabling admin API")
+	}
+	if len(cfg.TagPolicies) > 0 {
+		slog.InfoContext(ctx, "Using tag policies", "tag_policies", cfg.TagPolicies.String())
+	}
+	if cfg.htpasswd != nil {
+		slog.InfoContext(ctx, "Requiring htpasswd authentication", "htpasswd", cfg.HtpasswdPath, "users", len(cfg.htpasswd))
+	}
+	if cfg.TokenAuth {
+		slog.InfoContext(ctx, "Requiring token authentication", "access", cfg.AccessRules.String())
+	}
+	if cfg.DeleteEnabled {
+		slog.InfoContext(ctx, "Allowing deletes")
+	}
+	if cfg.proxyDomain != "" {
+		slog.InfoContext(ctx, "Pulling images without a namespace from the proxy remote URL", "proxy_remote_url", cfg.ProxyRemoteURL)
+	}
+	if cfg.DockerConfig != "" {
+		slog.InfoContext(ctx, "Using credentials from Docker config for clients without any", "docker_config", cfg.DockerConfig)
+	}
+	for _, warning := range cfg.warnings {
+		slog.WarnContext(ctx, "Problem with config", "warning", warning)
+	}
+}
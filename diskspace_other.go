@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// freeDiskSpace would return the number of bytes available on the filesystem
+// containing path, but isn't implemented on this platform, so reports that it
+// doesn't know.
+func freeDiskSpace(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// distributionSettings maps the settings of the official registry's config.yml
+// which mean something here, by their path, to the flags they correspond to.
+var distributionSettings = map[string]string{
+	"http.addr":                        "addr",
+	"http.tls.certificate":             "tls-cert",
+	"http.tls.key":                     "tls-key",
+	"auth.htpasswd.path":               "htpasswd",
+	"auth.htpasswd.realm":              "htpasswd-realm",
+	"storage.filesystem.rootdirectory": "cache-dir",
+	"storage.delete.enabled":           "delete-enabled",
+	"proxy.remoteurl":                  "proxy-remote-url",
+	"proxy.username":                   "proxy-username",
+	"proxy.password":                   "proxy-password",
+	"log.level":                        "log-level",
+	"log.formatter":                    "log-format",
+}
+
+// settings of the official registry which don't need anything done here, so
+// aren't worth a warning
+var ignoredDistributionSettings = []string{
+	"version",
+	"storage.filesystem.maxthreads",
+	"storage.cache.blobdescriptor",
+}
+
+// settings of the official registry with values that may have no equivalent
+// here, like the logstash log formatter, so they're ignored rather than refusing
+// to start
+var optionalDistributionSettings = []string{
+	"log.formatter",
+}
+
+const environDistributionPrefix = "REGISTRY_"
+
+// distributionEnvName is the environment variable which overrides a setting of
+// the official registry, like REGISTRY_HTTP_TLS_CERTIFICATE for http.tls.certificate.
+func distributionEnvName(path string) string {
+	return environDistributionPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// applyDistributionConfig sets flags from a config.yml of the official registry,
+// ignoring and returning warnings about the settings which have no equivalent here.
+func applyDistributionConfig(flags *flag.FlagSet, configPath string) ([]string, error) {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	if len(document.Content) == 0 {
+		// empty file
+		return nil, nil
+	}
+
+	var warnings []string
+	var walk func(path string, node *yaml.Node) error
+	walk = func(path string, node *yaml.Node) error {
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := strings.ToLower(node.Content[i].Value)
+				if path != "" {
+					key = fmt.Sprint(path, ".", key)
+				}
+				err := walk(key, node.Content[i+1])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if slices.Contains(ignoredDistributionSettings, path) {
+			return nil
+		}
+		name, ok := distributionSettings[path]
+		if !ok || node.Kind != yaml.ScalarNode {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: ignoring unsupported setting %s", configPath, node.Line, path))
+			return nil
+		}
+		err := flags.Set(name, node.Value)
+		if err != nil && slices.Contains(optionalDistributionSettings, path) {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: ignoring unsupported value %q for %s", configPath, node.Line, node.Value, path))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %w", configPath, node.Line, node.Value, path, err)
+		}
+		return nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: config should be a mapping of setting names to values", configPath, root.Line)
+	}
+	err = walk("", root)
+	return warnings, err
+}
+
+// applyDistributionEnv sets flags from the REGISTRY_* environment variables that
+// the official registry uses to override its config.yml, and returns warnings
+// about the ones which have no equivalent here.
+func applyDistributionEnv(flags *flag.FlagSet) ([]string, error) {
+	var warnings []string
+	environ := os.Environ()
+	slices.Sort(environ)
+	for _, env := range environ {
+		envName, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(envName, environDistributionPrefix) {
+			continue
+		}
+		found := false
+		for path, name := range distributionSettings {
+			if distributionEnvName(path) == envName {
+				found = true
+				err := flags.Set(name, value)
+				if err != nil && slices.Contains(optionalDistributionSettings, path) {
+					warnings = append(warnings, fmt.Sprintf("ignoring unsupported value %q for environment variable %s", value, envName))
+					continue
+				}
+				if err != nil {
+					return warnings, fmt.Errorf("invalid value %q for environment variable %s: %w", value, envName, err)
+				}
+			}
+		}
+		for _, path := range ignoredDistributionSettings {
+			if distributionEnvName(path) == envName {
+				found = true
+			}
+		}
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("ignoring unsupported environment variable %s", envName))
+		}
+	}
+	return warnings, nil
+}
+
+// proxyDomain returns the domain of images pulled through the proxy's remote
+// URL, like "docker.io" for "https://registry-1.docker.io", or "" if every
+// registry is proxied, depending on the ns query parameter of each request.
+func proxyDomain(remoteURL string) (string, error) {
+	if remoteURL == "" || remoteURL == "*" {
+		return "", nil
+	}
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%q should be a URL like https://registry-1.docker.io", remoteURL)
+	}
+	switch u.Host {
+	case "registry-1.docker.io", "index.docker.io", "registry.hub.docker.com":
+		return "docker.io", nil
+	}
+	return u.Host, nil
+}
+
+// loadHtpasswd reads an htpasswd file of users and bcrypt password hashes, the
+// only kind the official registry accepts, and returns warnings about lines
+// with other kinds of hashes, which are skipped.
+func loadHtpasswd(path string) (map[string][]byte, []string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	users := map[string][]byte{}
+	var warnings []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: ignoring user %q, only bcrypt passwords are supported (htpasswd -B)", path, line, user))
+			continue
+		}
+		users[user] = []byte(hash)
+	}
+	return users, warnings, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyDistributionConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		check    func(*Config) error
+		warnings []string
+		err      string
+	}{
+		{
+			name: "supported settings",
+			content: `version: 0.1
+http:
+  addr: :5001
+storage:
+  filesystem:
+    rootdirectory: /var/lib/registry
+  delete:
+    enabled: true
+proxy:
+  remoteurl: https://registry-1.docker.io
+  username: alice
+  password: secret
+log:
+  level: debug
+  formatter: json
+`,
+			check: func(cfg *Config) error {
+				if cfg.Addr != ":5001" || cfg.CacheDir != "/var/lib/registry" || !cfg.DeleteEnabled ||
+					cfg.ProxyRemoteURL != "https://registry-1.docker.io" || cfg.ProxyUsername != "alice" || cfg.ProxyPassword != "secret" ||
+					cfg.LogLevel.String() != "DEBUG" || cfg.LogFormat != "json" {
+					return fmt.Errorf("config = %+v", cfg)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "keys are case insensitive",
+			content: "HTTP:\n  Addr: :5002\n",
+			check: func(cfg *Config) error {
+				if cfg.Addr != ":5002" {
+					return fmt.Errorf("addr = %q, want :5002", cfg.Addr)
+				}
+				return nil
+			},
+		},
+		{
+			name:     "unsupported settings",
+			content:  "version: 0.1\nhttp:\n  secret: abc\nstorage:\n  s3:\n    bucket: images\n",
+			warnings: []string{"3: ignoring unsupported setting http.secret", "6: ignoring unsupported setting storage.s3.bucket"},
+		},
+		{
+			name:     "list settings",
+			content:  "notifications:\n  endpoints:\n    - name: alistener\n",
+			warnings: []string{"ignoring unsupported setting notifications.endpoints"},
+		},
+		{
+			name:     "unknown log formatter",
+			content:  "log:\n  formatter: logstash\n",
+			warnings: []string{`2: ignoring unsupported value "logstash" for log.formatter`},
+			check: func(cfg *Config) error {
+				if cfg.LogFormat != "text" {
+					return fmt.Errorf("log format = %q, want text", cfg.LogFormat)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "invalid value",
+			content: "storage:\n  delete:\n    enabled: sometimes\n",
+			err:     `3: invalid value "sometimes" for storage.delete.enabled`,
+		},
+		{
+			name:    "not a mapping",
+			content: "- http\n",
+			err:     "config should be a mapping",
+		},
+		{
+			name:    "empty",
+			content: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestFile(t, "config.yml", test.content)
+			cfg := defaultConfig()
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			cfg.registerFlags(flags)
+
+			warnings, err := applyDistributionConfig(flags, path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("applyDistributionConfig() = %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyDistributionConfig() = %v", err)
+			}
+			if len(warnings) != len(test.warnings) {
+				t.Fatalf("warnings = %q, want %q", warnings, test.warnings)
+			}
+			for i, warning := range warnings {
+				if !strings.Contains(warning, test.warnings[i]) {
+					t.Errorf("warning %q doesn't contain %q", warning, test.warnings[i])
+				}
+			}
+			if test.check != nil {
+				if err := test.check(cfg); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		users    []string
+		warnings []string
+		err      string
+	}{
+		{
+			name:    "bcrypt users",
+			content: fmt.Sprintf("# users\nalice:%s\n\nbob:%s\n", hash, hash),
+			users:   []string{"alice", "bob"},
+		},
+		{
+			name:     "other hashes",
+			content:  fmt.Sprintf("alice:%s\nbob:$apr1$abcdefgh$0123456789abcdefghijkl\ncarol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", hash),
+			users:    []string{"alice"},
+			warnings: []string{`2: ignoring user "bob"`, `3: ignoring user "carol"`},
+		},
+		{
+			name:    "malformed line",
+			content: fmt.Sprintf("alice:%s\nbob\n", hash),
+			err:     "2: expected user:hash",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, warnings, err := loadHtpasswd(writeTestFile(t, "htpasswd", test.content))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("loadHtpasswd() = %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadHtpasswd() = %v", err)
+			}
+			if len(users) != len(test.users) {
+				t.Errorf("users = %v, want %v", users, test.users)
+			}
+			for _, user := range test.users {
+				if bcrypt.CompareHashAndPassword(users[user], []byte("secret")) != nil {
+					t.Errorf("user %q doesn't have the right password", user)
+				}
+			}
+			if len(warnings) != len(test.warnings) {
+				t.Fatalf("warnings = %q, want %q", warnings, test.warnings)
+			}
+			for i, warning := range warnings {
+				if !strings.Contains(warning, test.warnings[i]) {
+					t.Errorf("warning %q doesn't contain %q", warning, test.warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProxyDomain(t *testing.T) {
+	tests := []struct {
+		remoteURL, want string
+		ok              bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"https://registry-1.docker.io", "docker.io", true},
+		{"https://index.docker.io", "docker.io", true},
+		{"https://ghcr.io", "ghcr.io", true},
+		{"http://localhost:5000", "localhost:5000", true},
+		{"registry-1.docker.io", "", false},
+	}
+	for _, test := range tests {
+		got, err := proxyDomain(test.remoteURL)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("proxyDomain(%q) = %q, %v, want %q, ok %v", test.remoteURL, got, err, test.want, test.ok)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
@@ -49,6 +51,13 @@ func DockerGetDaemonHost(ctx context.Context) (string, error) {
 	})
 }
 
+func DockerPing(ctx context.Context) error {
+	return withDockerClient(func(c *client.Client) error {
+		_, err := c.Ping(ctx)
+		return err
+	})
+}
+
 type DockerInfo struct {
 	ApiVersion         string
 	DaemonHost         string
@@ -92,6 +101,47 @@ func DockerImageInspect(ctx context.Context, reference string) (*image.InspectRe
 	})
 }
 
+// DockerImageListTags returns every tag of every image Docker has locally, like
+// "nginx:latest".
+func DockerImageListTags(ctx context.Context) ([]string, error) {
+	return withDockerClientValue(func(c *client.Client) ([]string, error) {
+		images, err := c.ImageList(ctx, image.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, image := range images {
+			for _, tag := range image.RepoTags {
+				if tag != "<none>:<none>" {
+					tags = append(tags, tag)
+				}
+			}
+		}
+		return tags, nil
+	})
+}
+
+// DockerWatchImageTags calls handler with the reference, like "myorg/app:dev",
+// whenever a local image is tagged, including by builds. It blocks until ctx is
+// done or the connection to Docker fails.
+func DockerWatchImageTags(ctx context.Context, handler func(reference string)) error {
+	return withDockerClient(func(c *client.Client) error {
+		messages, errs := c.Events(ctx, events.ListOptions{
+			Filters: filters.NewArgs(filters.Arg("type", string(events.ImageEventType)), filters.Arg("event", string(events.ActionTag))),
+		})
+		for {
+			select {
+			case message := <-messages:
+				if name := message.Actor.Attributes["name"]; name != "" {
+					handler(name)
+				}
+			case err := <-errs:
+				return err
+			}
+		}
+	})
+}
+
 type ImageAuthConfig = registry.AuthConfig
 
 func DockerImagePull(ctx context.Context, reference string, auth *ImageAuthConfig, statusHandler func(statusMessage string)) (bool, error) {
@@ -135,6 +185,26 @@ func DockerImagePull(ctx context.Context, reference string, auth *ImageAuthConfi
 	})
 }
 
+// DockerDistributionInspect asks the upstream registry for the digest that reference
+// currently points to, without pulling the image.
+func DockerDistributionInspect(ctx context.Context, reference string, auth *ImageAuthConfig) (string, error) {
+	return withDockerClientValue(func(c *client.Client) (string, error) {
+		var authstring string
+		if auth != nil {
+			var err error
+			authstring, err = registry.EncodeAuthConfig(*auth)
+			if err != nil {
+				return "", err
+			}
+		}
+		inspect, err := c.DistributionInspect(ctx, reference, authstring)
+		if err != nil {
+			return "", fmt.Errorf("error inspecting %s: %w", reference, err)
+		}
+		return inspect.Descriptor.Digest.String(), nil
+	})
+}
+
 func DockerImageExport(ctx context.Context, reference string, tarballHandler func(*tar.Reader) error) error {
 	return withDockerClient(func(c *client.Client) error {
 		resp, err := c.ImageSave(ctx, []string{reference})
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerConfigFile is the part of Docker's config.json which holds credentials,
+// as written by `docker login`.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// Docker Hub credentials are kept under this server URL
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// dockerConfigDomain turns a server URL from config.json, like
+// "https://index.docker.io/v1/" or "ghcr.io", into the domain used in the cache.
+func dockerConfigDomain(serverURL string) string {
+	domain := serverURL
+	if _, rest, ok := strings.Cut(domain, "://"); ok {
+		domain = rest
+	}
+	domain, _, _ = strings.Cut(domain, "/")
+	switch domain {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return domain
+}
+
+// dockerConfigServerURL finds the key of a map from config.json, out of those for
+// domain, preferring serverURL itself. Otherwise the first in sorted order is
+// used, so that the same one is picked every time.
+func dockerConfigServerURL[V any](entries map[string]V, domain, serverURL string) (string, bool) {
+	if _, ok := entries[serverURL]; ok {
+		return serverURL, true
+	}
+	var candidates []string
+	for candidate := range entries {
+		if dockerConfigDomain(candidate) == domain {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	slices.Sort(candidates)
+	return candidates[0], true
+}
+
+type cachedDockerConfig struct {
+	path    string
+	modTime time.Time
+	size    int64
+	config  dockerConfigFile
+}
+
+// the last config.json read, which is read again when it changes
+var dockerConfigCache struct {
+	mu     sync.Mutex
+	cached *cachedDockerConfig
+}
+
+// readDockerConfig reads and parses a config.json, unless it hasn't changed since
+// it was last read.
+func readDockerConfig(path string) (dockerConfigFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return dockerConfigFile{}, err
+	}
+	dockerConfigCache.mu.Lock()
+	defer dockerConfigCache.mu.Unlock()
+	cached := dockerConfigCache.cached
+	if cached != nil && cached.path == path && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.config, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return dockerConfigFile{}, err
+	}
+	var config dockerConfigFile
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return dockerConfigFile{}, err
+	}
+	dockerConfigCache.cached = &cachedDockerConfig{path, info.ModTime(), info.Size(), config}
+	return config, nil
+}
+
+// how long to remember credentials from a credential helper, so that they're not
+// run for every request
+const credentialHelperCacheTTL = time.Minute
+
+// how long to wait for a credential helper
+const credentialHelperTimeout = 10 * time.Second
+
+type credentialHelperResult struct {
+	auth    *ImageAuthConfig
+	expires time.Time
+}
+
+// credentials from credential helpers, by helper and server URL
+var credentialHelperCache sync.Map
+
+// runCredentialHelper gets the credentials for a server URL from a Docker
+// credential helper, like docker-credential-pass, or returns nil if it doesn't
+// have any.
+func runCredentialHelper(ctx context.Context, helper, serverURL string) *ImageAuthConfig {
+	key := fmt.Sprint(helper, " ", serverURL)
+	if cached, ok := credentialHelperCache.Load(key); ok && time.Now().Before(cached.(credentialHelperResult).expires) {
+		return cached.(credentialHelperResult).auth
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+	program := fmt.Sprint("docker-credential-", helper)
+	cmd := exec.CommandContext(ctx, program, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	var auth *ImageAuthConfig
+	var exitErr *exec.ExitError
+	output := strings.TrimSpace(stdout.String() + stderr.String())
+	switch {
+	case err == nil:
+		var credentials struct {
+			Username string `json:"Username"`
+			Secret   string `json:"Secret"`
+		}
+		err = json.Unmarshal(stdout.Bytes(), &credentials)
+		if err != nil {
+			slog.WarnContext(ctx, "Error reading output of Docker credential helper", "helper", program, "server", serverURL, "error", err)
+		} else if credentials.Username == "<token>" {
+			// helpers return identity tokens with this placeholder username
+			auth = &ImageAuthConfig{IdentityToken: credentials.Secret}
+		} else {
+			auth = &ImageAuthConfig{Username: credentials.Username, Password: credentials.Secret}
+		}
+	case errors.As(err, &exitErr) && strings.Contains(output, "credentials not found"):
+		// the helper has nothing for this server
+	default:
+		slog.WarnContext(ctx, "Error running Docker credential helper", "helper", program, "server", serverURL, "error", err, "output", output)
+	}
+	credentialHelperCache.Store(key, credentialHelperResult{auth, time.Now().Add(credentialHelperCacheTTL)})
+	return auth
+}
+
+// dockerConfigAuth returns the credentials that Docker would use for domain,
+// from the config.json given with -docker-config, or nil if there aren't any.
+// Like Docker, a credential helper for the domain takes precedence over the
+// credentials store, which takes precedence over credentials in the file.
+func dockerConfigAuth(ctx context.Context, domain string) *ImageAuthConfig {
+	path := currentConfig().DockerConfig
+	if path == "" {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "config.json")
+	}
+	config, err := readDockerConfig(path)
+	if err != nil {
+		slog.WarnContext(ctx, "Error reading Docker config", "docker_config", path, "error", err)
+		return nil
+	}
+
+	// find the server URL that Docker keeps the domain's credentials under
+	serverURL := domain
+	if domain == "docker.io" {
+		serverURL = dockerHubServerURL
+	}
+	if candidate, ok := dockerConfigServerURL(config.Auths, domain, serverURL); ok {
+		serverURL = candidate
+	}
+
+	if candidate, ok := dockerConfigServerURL(config.CredHelpers, domain, serverURL); ok {
+		return runCredentialHelper(ctx, config.CredHelpers[candidate], serverURL)
+	}
+	if config.CredsStore != "" {
+		return runCredentialHelper(ctx, config.CredsStore, serverURL)
+	}
+	entry, ok := config.Auths[serverURL]
+	if !ok {
+		return nil
+	}
+	if entry.IdentityToken != "" {
+		return &ImageAuthConfig{IdentityToken: entry.IdentityToken}
+	}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if err != nil || !ok {
+			slog.WarnContext(ctx, "Invalid credentials in Docker config", "docker_config", path, "server", serverURL)
+			return nil
+		}
+		return &ImageAuthConfig{Username: username, Password: password}
+	}
+	if entry.Username != "" {
+		return &ImageAuthConfig{Username: entry.Username, Password: entry.Password}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// FileLock is an exclusive advisory lock on a file. On this platform, file locks
+// aren't implemented and only KeyedMutexPool serializes access to the cache, so
+// the cache directory can't be shared between multiple processes.
+type FileLock struct{}
+
+// LockFile would block until it can take an exclusive lock on filename, but
+// doesn't do anything on this platform.
+func LockFile(filename string) (*FileLock, error) {
+	return &FileLock{}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return nil
+}
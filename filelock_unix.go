@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileLock is an exclusive advisory lock on a file, which is respected by other
+// processes (such as another k3d-registry-dockerd sharing the same cache directory)
+// as well as this one.
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile blocks until it can take an exclusive lock on filename, creating the
+// file and its parent directories if necessary.
+func LockFile(filename string) (*FileLock, error) {
+	err := os.MkdirAll(filepath.Dir(filename), 0777)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	// closing the file releases the lock too, but be explicit about it
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type healthCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func writeHealthStatus(w http.ResponseWriter, status healthStatus, statusCode int) {
+	content, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(append(content, '\n'))
+}
+
+// handleHealthz reports that the process is up and serving HTTP requests.
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	writeHealthStatus(w, healthStatus{Status: "ok"}, http.StatusOK)
+}
+
+// handleReadyz reports whether the registry can actually serve images: Docker
+// has to be reachable, and the cache has to be writable and not out of space.
+func handleReadyz(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"docker":         checkDockerReachable(ctx),
+		"cache_writable": checkCacheWritable(),
+		"disk_space":     checkDiskSpace(),
+	}
+	if warmImagesTotal.Load() > 0 {
+		checks["warm_images"] = checkWarmImages()
+	}
+	status := healthStatus{Status: "ready", Checks: checks}
+	statusCode := http.StatusOK
+	for _, check := range checks {
+		if !check.Ok {
+			status.Status = "not ready"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	writeHealthStatus(w, status, statusCode)
+}
+
+func checkDockerReachable(ctx context.Context) healthCheck {
+	err := DockerPing(ctx)
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	return healthCheck{Ok: true}
+}
+
+func checkCacheWritable() healthCheck {
+	err := os.MkdirAll(CACHE_DIRECTORY, 0777)
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	f, err := os.CreateTemp(CACHE_DIRECTORY, ".readyz")
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	f.Close()
+	err = os.Remove(f.Name())
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	return healthCheck{Ok: true}
+}
+
+func checkDiskSpace() healthCheck {
+	free, known, err := freeDiskSpace(CACHE_DIRECTORY)
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	if !known {
+		return healthCheck{true, "free disk space unknown on this platform"}
+	}
+	// readyz fails if there's less than this much free space for the cache
+	minFreeDiskBytes := currentConfig().MinFreeDiskBytes
+	detail := fmt.Sprintf("%d MiB free, %d MiB required", free/1024/1024, minFreeDiskBytes/1024/1024)
+	return healthCheck{free >= minFreeDiskBytes, detail}
+}
+
+// waitForDocker logs information about the Docker daemon once it's reachable,
+// retrying in the background if it isn't yet. Requests that need Docker will fail
+// until then, and /readyz will report that the registry isn't ready. The returned
+// channel is closed once Docker is reachable.
+func waitForDocker(ctx context.Context) <-chan struct{} {
+	connected := make(chan struct{})
+	logDockerInfo := func() bool {
+		err := DockerPing(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Docker isn't reachable yet, will keep trying", "error", err)
+			return false
+		}
+		info, err := DockerGetInfo(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Docker isn't reachable yet, will keep trying", "error", err)
+			return false
+		}
+		slog.InfoContext(ctx, "Connected to Docker",
+			"api_version", info.ApiVersion,
+			"daemon_host", info.DaemonHost,
+			"server_version", info.ServerVersion,
+			"server_os_type", info.ServerOSType,
+			"server_architecture", info.ServerArchitecture)
+		return true
+	}
+
+	if logDockerInfo() {
+		close(connected)
+		return connected
+	}
+	go func() {
+		delay := time.Second
+		for {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if logDockerInfo() {
+				close(connected)
+				return
+			}
+			delay = min(delay*2, 30*time.Second)
+		}
+	}()
+	return connected
+}
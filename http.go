@@ -1,9 +1,18 @@
 package main
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -49,22 +58,59 @@ func (router RegexpServeMux) ServeHTTP(w http.ResponseWriter, req *http.Request)
 }
 
 // LoggingMiddleware returns an http.Handler which logs responses to incoming
-// HTTP requests.
+// HTTP requests. Each request gets an ID (taken from the X-Request-Id header if
+// the client sent one) which is attached to everything logged while handling it,
+// and a tracing span which is the parent of any spans started while handling it.
 func LoggingMiddleware(inner http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get("X-Request-Id")
+		if requestId == "" {
+			buf := make([]byte, 8)
+			_, _ = rand.Read(buf)
+			requestId = hex.EncodeToString(buf)
+		}
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, fmt.Sprint(req.Method, " ", req.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("url.query", req.URL.RawQuery),
+				attribute.String("request_id", requestId),
+			))
+		defer span.End()
+		ctx = WithLogAttrs(ctx, "request_id", requestId)
+		if span.SpanContext().IsValid() {
+			ctx = WithLogAttrs(ctx, "trace_id", span.SpanContext().TraceID().String())
+		}
+		req = req.WithContext(ctx)
+
 		loggingWriter := &loggingResponseWriter{w, 200, nil}
 		startTime := time.Now()
 		inner.ServeHTTP(loggingWriter, req)
 		responseDuration := time.Now().Sub(startTime)
 
-		var errorPart string
+		span.SetAttributes(attribute.Int("http.response.status_code", loggingWriter.StatusCode))
+		if loggingWriter.StatusCode/100 == 5 {
+			span.SetStatus(codes.Error, http.StatusText(loggingWriter.StatusCode))
+		}
+
+		level := slog.LevelInfo
+		attrs := []any{
+			"status", loggingWriter.StatusCode,
+			"method", req.Method,
+			"url", req.URL.String(),
+			"duration", responseDuration,
+		}
 		if loggingWriter.StatusIsError() {
-			errorPart += " - " + string(loggingWriter.ErrorBody)
+			attrs = append(attrs, "error", strings.TrimSpace(string(loggingWriter.ErrorBody)))
+		}
+		if loggingWriter.StatusCode/100 == 5 {
+			level = slog.LevelError
 		}
-		log.Printf("%d %s - %s %s - (%v)%s",
-			loggingWriter.StatusCode, http.StatusText(loggingWriter.StatusCode),
-			req.Method, req.URL.String(), responseDuration, errorPart,
-		)
+		slog.Log(ctx, level, fmt.Sprintf("%d %s - %s %s",
+			loggingWriter.StatusCode, http.StatusText(loggingWriter.StatusCode), req.Method, req.URL.String()),
+			attrs...)
 	})
 }
 
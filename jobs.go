@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job tracks a pull and export in progress, so that the status page can show
+// what's currently happening.
+type Job struct {
+	Image     string
+	Reference string
+	Started   time.Time
+
+	mu       sync.Mutex
+	stage    string
+	progress string
+}
+
+// JobStatus is a snapshot of a Job.
+type JobStatus struct {
+	Image     string
+	Reference string
+	Started   time.Time
+	Stage     string
+	Progress  string
+}
+
+type jobKey struct{}
+
+var activeJobs sync.Map
+
+// StartJob registers a new job, and returns a context which lets anything doing
+// work for the job update its status. The job is removed once done is called. If
+// ctx already belongs to a job, that job is used instead.
+func StartJob(ctx context.Context, imageName, imageTagOrDigest string) (context.Context, func()) {
+	if _, ok := ctx.Value(jobKey{}).(*Job); ok {
+		return ctx, func() {}
+	}
+	job := &Job{Image: imageName, Reference: imageTagOrDigest, Started: time.Now(), stage: "starting"}
+	activeJobs.Store(job, true)
+	return context.WithValue(ctx, jobKey{}, job), func() {
+		activeJobs.Delete(job)
+	}
+}
+
+// SetJobStage sets what the job in ctx is currently doing, if there is one.
+func SetJobStage(ctx context.Context, stage string) {
+	if job, ok := ctx.Value(jobKey{}).(*Job); ok {
+		job.mu.Lock()
+		job.stage = stage
+		job.progress = ""
+		job.mu.Unlock()
+	}
+}
+
+// SetJobProgress sets the latest progress message of the job in ctx, if there is
+// one. Docker's JSON progress messages are turned into something more readable.
+func SetJobProgress(ctx context.Context, message string) {
+	job, ok := ctx.Value(jobKey{}).(*Job)
+	if !ok {
+		return
+	}
+	var msg jsonmessage.JSONMessage
+	if err := json.Unmarshal([]byte(message), &msg); err == nil && msg.Status != "" {
+		parts := []string{}
+		if msg.ID != "" {
+			parts = append(parts, fmt.Sprint(msg.ID, ":"))
+		}
+		parts = append(parts, msg.Status)
+		if msg.Progress != nil {
+			parts = append(parts, msg.Progress.String())
+		}
+		message = strings.Join(parts, " ")
+	}
+	job.mu.Lock()
+	job.progress = message
+	job.mu.Unlock()
+}
+
+// ActiveJobs returns the status of all running jobs, oldest first.
+func ActiveJobs() []JobStatus {
+	var jobs []JobStatus
+	activeJobs.Range(func(key, value any) bool {
+		job := key.(*Job)
+		job.mu.Lock()
+		jobs = append(jobs, JobStatus{job.Image, job.Reference, job.Started, job.stage, job.progress})
+		job.mu.Unlock()
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+	return jobs
+}
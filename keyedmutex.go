@@ -1,48 +1,154 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 )
 
 // KeyedMutexPool exposes locks based on a passed in key, so that
 // only one goroutine may be working on any specific key at one time,
 // while other goroutines can work on other keys.
+//
+// It can also coalesce calls for the same key, so that goroutines
+// which arrive while a call is already in flight share its result
+// instead of running it again.
 
 type KeyedMutexPoolEntry struct {
 	count int
-	cond  *sync.Cond
-	mu    sync.Mutex
+	sem   chan struct{}
+}
+
+type keyedMutexPoolCall struct {
+	done   chan struct{}
+	result any
+	err    error
+}
+
+// KeyedMutexPoolStats reports how much contention a KeyedMutexPool has seen.
+type KeyedMutexPoolStats struct {
+	// Number of goroutines currently waiting for a key held by another goroutine
+	Waiting int
+	// Number of goroutines currently holding a key
+	Running int
+	// Number of calls to Do which finished waiting, successfully or not
+	TotalWaits int64
+	// Total time spent waiting in calls to Do
+	TotalWaitTime time.Duration
+	// Number of calls to DoShared which shared the result of an in-flight call
+	TotalShared int64
 }
 
 type KeyedMutexPool struct {
 	mu      sync.Mutex
 	entries map[string]*KeyedMutexPoolEntry
+	calls   map[string]*keyedMutexPoolCall
+	stats   KeyedMutexPoolStats
 }
 
-func (pool *KeyedMutexPool) Do(key string, f func() (any, error)) (any, error) {
+// Do waits until no other goroutine is working on key, and then calls f. If ctx
+// is cancelled while waiting, Do gives up and returns ctx.Err() without calling f.
+func (pool *KeyedMutexPool) Do(ctx context.Context, key string, f func() (any, error)) (any, error) {
 	pool.mu.Lock()
 	if pool.entries == nil {
 		pool.entries = make(map[string]*KeyedMutexPoolEntry)
 	}
 	c, ok := pool.entries[key]
 	if !ok {
-		c = new(KeyedMutexPoolEntry)
-		c.cond = sync.NewCond(&c.mu)
+		c = &KeyedMutexPoolEntry{sem: make(chan struct{}, 1)}
 		pool.entries[key] = c
 	}
 	c.count++
+	pool.stats.Waiting++
 	pool.mu.Unlock()
-	c.mu.Lock()
 
-	result, err := f()
+	startTime := time.Now()
+	var err error
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
 
 	pool.mu.Lock()
-	c.count--
-	if c.count == 0 {
-		delete(pool.entries, key)
+	pool.stats.Waiting--
+	pool.stats.TotalWaits++
+	pool.stats.TotalWaitTime += time.Since(startTime)
+	if err == nil {
+		pool.stats.Running++
 	}
 	pool.mu.Unlock()
-	c.mu.Unlock()
 
-	return result, err
+	release := func() {
+		pool.mu.Lock()
+		c.count--
+		if c.count == 0 {
+			delete(pool.entries, key)
+		}
+		pool.mu.Unlock()
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	defer func() {
+		pool.mu.Lock()
+		pool.stats.Running--
+		pool.mu.Unlock()
+		<-c.sem
+		release()
+	}()
+
+	return f()
+}
+
+// DoShared calls f, unless a call for key is already in flight, in which case it
+// waits for and returns that call's result instead. shared reports whether the
+// result came from another goroutine's call. If ctx is cancelled while waiting,
+// DoShared returns ctx.Err(), but the call itself keeps running for anyone else
+// waiting on it, so f shouldn't depend on the context of any single caller. If f
+// panics, the panic is returned as an error, since f runs in its own goroutine
+// where nothing else could recover it.
+func (pool *KeyedMutexPool) DoShared(ctx context.Context, key string, f func() (any, error)) (result any, shared bool, err error) {
+	pool.mu.Lock()
+	if pool.calls == nil {
+		pool.calls = make(map[string]*keyedMutexPoolCall)
+	}
+	call, ok := pool.calls[key]
+	if ok {
+		pool.stats.TotalShared++
+	} else {
+		call = &keyedMutexPoolCall{done: make(chan struct{})}
+		pool.calls[key] = call
+		pool.stats.Running++
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					call.result, call.err = nil, fmt.Errorf("panic: %v", r)
+				}
+				pool.mu.Lock()
+				pool.stats.Running--
+				delete(pool.calls, key)
+				pool.mu.Unlock()
+				close(call.done)
+			}()
+			call.result, call.err = f()
+		}()
+	}
+	pool.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, ok, call.err
+	case <-ctx.Done():
+		return nil, ok, ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the pool's contention statistics.
+func (pool *KeyedMutexPool) Stats() KeyedMutexPoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.stats
 }
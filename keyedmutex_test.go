@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexPoolDoShared(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, pool *KeyedMutexPool)
+	}{
+		{"coalesces calls", func(t *testing.T, pool *KeyedMutexPool) {
+			var calls atomic.Int32
+			release := make(chan struct{})
+			f := func() (any, error) {
+				calls.Add(1)
+				<-release
+				return "result", nil
+			}
+
+			const callers = 5
+			var wg sync.WaitGroup
+			var sharedCount atomic.Int32
+			for range callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, shared, err := pool.DoShared(context.Background(), "key", f)
+					if result != "result" || err != nil {
+						t.Errorf("DoShared() = %v, %v, want result", result, err)
+					}
+					if shared {
+						sharedCount.Add(1)
+					}
+				}()
+			}
+			// let every caller join the call in flight before it finishes
+			for pool.Stats().TotalShared < callers-1 {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			wg.Wait()
+
+			if calls.Load() != 1 {
+				t.Errorf("f was called %d times, want once", calls.Load())
+			}
+			if sharedCount.Load() != callers-1 {
+				t.Errorf("%d callers shared the result, want %d", sharedCount.Load(), callers-1)
+			}
+		}},
+		{"calls again once finished", func(t *testing.T, pool *KeyedMutexPool) {
+			var calls atomic.Int32
+			f := func() (any, error) {
+				return calls.Add(1), nil
+			}
+			for want := int32(1); want <= 2; want++ {
+				result, shared, err := pool.DoShared(context.Background(), "key", f)
+				if result != want || shared || err != nil {
+					t.Errorf("DoShared() = %v, %v, %v, want %v, false, nil", result, shared, err, want)
+				}
+			}
+		}},
+		{"separate keys", func(t *testing.T, pool *KeyedMutexPool) {
+			release := make(chan struct{})
+			go pool.DoShared(context.Background(), "a", func() (any, error) {
+				<-release
+				return nil, nil
+			})
+			defer close(release)
+			result, shared, err := pool.DoShared(context.Background(), "b", func() (any, error) {
+				return "b", nil
+			})
+			if result != "b" || shared || err != nil {
+				t.Errorf("DoShared() = %v, %v, %v, want b, false, nil", result, shared, err)
+			}
+		}},
+		{"cancellation", func(t *testing.T, pool *KeyedMutexPool) {
+			release := make(chan struct{})
+			finished := make(chan struct{})
+			f := func() (any, error) {
+				<-release
+				close(finished)
+				return "result", nil
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				for pool.Stats().Running == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				cancel()
+			}()
+			result, _, err := pool.DoShared(ctx, "key", f)
+			if result != nil || !errors.Is(err, context.Canceled) {
+				t.Errorf("DoShared() = %v, %v, want context.Canceled", result, err)
+			}
+
+			// the call keeps running for the others waiting on it
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				result, shared, err := pool.DoShared(context.Background(), "key", f)
+				if result != "result" || !shared || err != nil {
+					t.Errorf("DoShared() = %v, %v, %v, want the cancelled call's result", result, shared, err)
+				}
+			}()
+			for pool.Stats().TotalShared == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			<-done
+			<-finished
+		}},
+		{"panics", func(t *testing.T, pool *KeyedMutexPool) {
+			result, _, err := pool.DoShared(context.Background(), "key", func() (any, error) {
+				panic("oops")
+			})
+			if result != nil || err == nil || !strings.Contains(err.Error(), "panic: oops") {
+				t.Errorf("DoShared() = %v, %v, want the panic as an error", result, err)
+			}
+			// the key is free again
+			result, shared, err := pool.DoShared(context.Background(), "key", func() (any, error) {
+				return "result", nil
+			})
+			if result != "result" || shared || err != nil {
+				t.Errorf("DoShared() after a panic = %v, %v, %v, want result", result, shared, err)
+			}
+			if running := pool.Stats().Running; running != 0 {
+				t.Errorf("%d calls still running", running)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, &KeyedMutexPool{})
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a copy of ctx which adds the given attributes (as key-value
+// pairs or slog.Attrs, like slog.Logger.Info) to every record logged with it. This
+// lets request IDs, image names, and references follow a request around without
+// passing a logger everywhere.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs := slices.Clone(existing)
+	var r slog.Record
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// contextHandler is a slog.Handler which adds attributes set with WithLogAttrs to
+// records before passing them on to another handler.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	if r.Level >= slog.LevelWarn {
+		recentErrors.Add(r)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewLogHandler creates the handler used for all logging, given a minimum level
+// and a format of "text" or "json".
+func NewLogHandler(w io.Writer, level slog.Leveler, format string) (slog.Handler, error) {
+	opts := slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return contextHandler{slog.NewTextHandler(w, &opts)}, nil
+	case "json":
+		return contextHandler{slog.NewJSONHandler(w, &opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// LogEntry is a warning or error that was logged, kept for the status page.
+type LogEntry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   string
+	// the image it was about, if any
+	Image string
+}
+
+// LogRing keeps the most recent warnings and errors in memory.
+type LogRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+}
+
+// how many warnings and errors to keep for the status page
+const recentErrorsSize = 50
+
+var recentErrors LogRing
+
+func (ring *LogRing) Add(r slog.Record) {
+	var attrs []string
+	image := ""
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a.String())
+		if a.Key == "image" {
+			image = a.Value.String()
+		}
+		return true
+	})
+	entry := LogEntry{r.Time, r.Level, r.Message, strings.Join(attrs, " "), image}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if len(ring.entries) < recentErrorsSize {
+		ring.entries = append(ring.entries, entry)
+	} else {
+		ring.entries[ring.next] = entry
+	}
+	ring.next = (ring.next + 1) % recentErrorsSize
+}
+
+// Entries returns the kept entries, newest first.
+func (ring *LogRing) Entries() []LogEntry {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	entries := make([]LogEntry, 0, len(ring.entries))
+	for i := 0; i < len(ring.entries); i++ {
+		j := (ring.next - 1 - i + 2*len(ring.entries)) % len(ring.entries)
+		entries = append(entries, ring.entries[j])
+	}
+	return entries
+}
@@ -9,24 +9,28 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func handleHelloWorld(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprint(w, "Hello, world!\n")
-}
-
 func handleV2(w http.ResponseWriter, req *http.Request) {
 	// path has to return 2xx but doesn't have to have content
 }
 
-func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string, auth *ImageAuthConfig) (bool, error) {
+func dockerImageReference(imageName, imageTagOrDigest string) string {
 	// turn image name and tagOrDigest into a single string that's recognizable
 	// as an image by Docker.
 	var fullName string
@@ -46,35 +50,69 @@ func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string,
 			fullName = strings.TrimPrefix(fullName, "library/")
 		}
 	}
+	return fullName
+}
+
+func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string, auth *ImageAuthConfig) (bool, error) {
+	fullName := dockerImageReference(imageName, imageTagOrDigest)
+	ctx = WithLogAttrs(ctx, "docker_reference", fullName)
+	ctx, done := StartJob(ctx, imageName, imageTagOrDigest)
+	defer done()
 
 	// find or pull image.
-	image, err := DockerImageInspect(ctx, fullName)
+	SetJobStage(ctx, "inspecting")
+	spanCtx, span := startSpan(ctx, "docker image inspect")
+	image, err := DockerImageInspect(spanCtx, fullName)
+	endSpan(span, err)
 	if err != nil {
 		return false, err
 	}
 	if image == nil {
+		SetJobStage(ctx, "pulling")
 		if auth == nil {
-			log.Printf("Pulling Docker image %s", fullName)
+			slog.InfoContext(ctx, "Pulling Docker image")
 		} else {
-			log.Printf("Pulling Docker image %s (credentials supplied for username=%q)", fullName, auth.Username)
+			slog.InfoContext(ctx, "Pulling Docker image with supplied credentials", "username", auth.Username)
 		}
-		found, err := DockerImagePull(ctx, fullName, auth, func(statusMessage string) {
-			log.Println(statusMessage)
+		startTime := time.Now()
+		spanCtx, span := startSpan(ctx, "docker image pull")
+		found, err := DockerImagePull(spanCtx, fullName, auth, func(statusMessage string) {
+			slog.DebugContext(ctx, statusMessage)
+			SetJobProgress(ctx, statusMessage)
 		})
+		span.SetAttributes(attribute.Bool("found", found))
+		endSpan(span, err)
+		observeDockerOperation("pull", startTime, err)
 		if err != nil {
 			return false, err
 		}
 		if !found {
-			log.Printf("Couldn't find Docker image %s", fullName)
+			slog.InfoContext(ctx, "Couldn't find Docker image")
 			return false, nil
 		}
+		slog.InfoContext(ctx, "Pulled Docker image", "duration", time.Since(startTime))
 	}
 
 	// export it into our local cache.
-	log.Printf("Exporting Docker image %s", fullName)
-	err = DockerImageExport(ctx, fullName, func(tarball *tar.Reader) error {
-		return saveOciImageToCache(imageName, imageTagOrDigest, tarball)
+	slog.InfoContext(ctx, "Exporting Docker image")
+	SetJobStage(ctx, "exporting")
+	startTime := time.Now()
+	spanCtx, span = startSpan(ctx, "docker image export")
+	err = DockerImageExport(spanCtx, fullName, func(tarball *tar.Reader) error {
+		return saveOciImageToCache(spanCtx, imageName, imageTagOrDigest, tarball)
 	})
+	endSpan(span, err)
+	observeDockerOperation("export", startTime, err)
+	if err != nil {
+		return false, err
+	}
+	slog.InfoContext(ctx, "Exported Docker image", "duration", time.Since(startTime))
+
+	// images which need credentials to pull mustn't be served to clients without
+	// them. check whoever asked for it, since the image may have already been in
+	// Docker after being pulled with credentials some other way.
+	checkedPrivateImages.Delete(fullName)
+	err = checkImageIfPrivate(ctx, imageName, fullName)
 	if err != nil {
 		return false, err
 	}
@@ -93,11 +131,12 @@ func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string,
 			return false, err
 		}
 		if !exists {
-			log.Printf(
-				"Error: exported Docker image %s was missing blob %s. This is known to happen when referencing"+
+			missingBlobDetectionsTotal.WithLabelValues("digest").Inc()
+			slog.WarnContext(ctx,
+				"Exported Docker image was missing the blob it was referenced by. This is known to happen when referencing"+
 					" images directly by SHA256-digest. To export this image correctly, switch to Docker's containerd"+
 					" image store: https://docs.docker.com/desktop/features/containerd/",
-				fullName, imageTagOrDigest)
+				"digest", imageTagOrDigest)
 			// report that the image was not found, so that we return HTTP 404. this
 			// lets k8s know to try another registry, rather than looping forever
 			// retrying an HTTP 500.
@@ -124,46 +163,64 @@ func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string,
 		}
 		manifestDigest = index.Manifests[0].Digest.Encoded()
 	}
-	blobsExist, err := checkManifestAndReferencedBlobsExist(imageName, manifestDigest)
+	SetJobStage(ctx, "checking blobs")
+	spanCtx, span = startSpan(ctx, "check blobs exist")
+	blobsExist, err := checkManifestAndReferencedBlobsExist(spanCtx, imageName, manifestDigest)
+	span.SetAttributes(attribute.Bool("blobs_exist", blobsExist))
+	endSpan(span, err)
 	if err != nil {
 		return false, err
 	}
 	if !blobsExist {
 		// try to fix the image by going through Buildkit, which will download all of the
 		// blobs and fix future exports.
-		log.Printf("Attempting to fix %s using BuildKit", fullName)
-		err = BuildkitForceDockerPull(ctx, fullName)
+		missingBlobDetectionsTotal.WithLabelValues("layers").Inc()
+		slog.InfoContext(ctx, "Attempting to fix Docker image using BuildKit")
+		SetJobStage(ctx, "repairing with BuildKit")
+		startTime := time.Now()
+		spanCtx, span := startSpan(ctx, "buildkit repair")
+		err = BuildkitForceDockerPull(spanCtx, fullName)
+		endSpan(span, err)
+		observeDockerOperation("buildkit_repair", startTime, err)
 		if err != nil {
 			// if we get an error, just print and move on
-			log.Printf("Error while attempting to use BuildKit: %s", err)
+			slog.ErrorContext(ctx, "Error while attempting to use BuildKit", "error", err)
 		} else {
 			// if BuildKit was successful, re-export image and check it again
-			log.Printf("Re-exporting %s", fullName)
-			err = DockerImageExport(ctx, fullName, func(tarball *tar.Reader) error {
-				return saveOciImageToCache(imageName, imageTagOrDigest, tarball)
+			slog.InfoContext(ctx, "Re-exporting Docker image", "buildkit_duration", time.Since(startTime))
+			SetJobStage(ctx, "re-exporting")
+			startTime := time.Now()
+			spanCtx, span := startSpan(ctx, "docker image export")
+			err = DockerImageExport(spanCtx, fullName, func(tarball *tar.Reader) error {
+				return saveOciImageToCache(spanCtx, imageName, imageTagOrDigest, tarball)
 			})
+			endSpan(span, err)
+			observeDockerOperation("export", startTime, err)
 			if err != nil {
 				return false, err
 			}
-			blobsExist, err = checkManifestAndReferencedBlobsExist(imageName, manifestDigest)
+			slog.InfoContext(ctx, "Re-exported Docker image", "duration", time.Since(startTime))
+			spanCtx, span = startSpan(ctx, "check blobs exist")
+			blobsExist, err = checkManifestAndReferencedBlobsExist(spanCtx, imageName, manifestDigest)
+			span.SetAttributes(attribute.Bool("blobs_exist", blobsExist))
+			endSpan(span, err)
 			if err != nil {
 				return false, err
 			}
 		}
 	}
 	if !blobsExist {
-		log.Printf(
-			"Error: exported Docker image %s was missing referenced blobs. This is known to happen when"+
+		slog.WarnContext(ctx,
+			"Exported Docker image was missing referenced blobs. This is known to happen when"+
 				" using Docker's containerd image store and pulling images that share layers. See"+
-				" https://github.com/ligfx/k3d-registry-dockerd/issues/13 and https://github.com/moby/moby/issues/49473",
-			fullName)
+				" https://github.com/ligfx/k3d-registry-dockerd/issues/13 and https://github.com/moby/moby/issues/49473")
 		// remove the index so that we don't return HTTP 200 in the future.
 		if !strings.HasPrefix(imageTagOrDigest, "sha256:") {
 			err := os.Remove(cachedIndexFilename(imageName, imageTagOrDigest))
 			if err != nil {
 				return false, err
 			}
-			log.Printf("Removing %s index.json", fullName)
+			slog.InfoContext(ctx, "Removed index.json")
 		}
 		// report that the image was not found, so that we return HTTP 404. this
 		// lets k8s know to try another registry, rather than looping forever
@@ -171,11 +228,14 @@ func findAndExportImage(ctx context.Context, imageName, imageTagOrDigest string,
 		return false, nil
 	}
 
+	if !strings.HasPrefix(imageTagOrDigest, "sha256:") {
+		recordUpstreamDigest(ctx, imageName, imageTagOrDigest, auth)
+	}
 	return true, nil
 }
 
 // const CACHE_DIRECTORY = "/var/lib/k3d-registry-dockerd/cache"
-const CACHE_DIRECTORY = "cache"
+var CACHE_DIRECTORY = "cache"
 
 func cachedImageDirectory(imageName string) string {
 	safeImageName := url.QueryEscape(imageName)
@@ -185,6 +245,48 @@ func cachedImageDirectory(imageName string) string {
 	return fmt.Sprint(CACHE_DIRECTORY, "/", safeImageName)
 }
 
+// tags and digests as allowed by the distribution spec, which also keeps them
+// from escaping the cache directory
+var referencePattern = regexp.MustCompile(`^(?:[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}|sha256:[a-f0-9]{64})$`)
+
+// validateReference checks that an image name and tag or digest from a client
+// can be used as paths in the cache.
+func validateReference(imageName, imageTagOrDigest string) error {
+	for _, component := range strings.Split(imageName, "/") {
+		if component == "" || component == "." || component == ".." {
+			return fmt.Errorf("invalid image name %q", imageName)
+		}
+	}
+	if !referencePattern.MatchString(imageTagOrDigest) {
+		return fmt.Errorf("invalid tag or digest %q", imageTagOrDigest)
+	}
+	return nil
+}
+
+// name of the lock held while writing blobs, which are shared by all references
+// to an image. tags can't start with a ".", so this can't collide with a tag.
+const blobsLockName = ".blobs"
+
+func cachedLockFilename(imageName, lockName string) string {
+	// lock files live outside of the image directories so they never show up as
+	// cache content. image names can't start with a ".", so this can't collide.
+	return fmt.Sprint(CACHE_DIRECTORY, "/.locks/", url.QueryEscape(imageName), "/", url.QueryEscape(lockName), ".lock")
+}
+
+// writeManifestIndex writes an index for a tag or digest pointing at a single
+// manifest.
+func writeManifestIndex(imageName, imageTagOrDigest, shasum string) (int64, error) {
+	// TODO: write a proper index file
+	indexContent := fmt.Sprintf(`{"manifests":[{"digest":"sha256:%s"}]}`, shasum)
+	bytesWritten, err := copyToFile(cachedIndexFilename(imageName, imageTagOrDigest), strings.NewReader(indexContent))
+	if err == nil {
+		// a client may have asked for it by tag or digest before it was pushed
+		negativeCache.Forget(imageName, imageTagOrDigest)
+		negativeCache.Forget(imageName, fmt.Sprint("sha256:", shasum))
+	}
+	return bytesWritten, err
+}
+
 func cachedIndexFilename(imageName, imageTagOrDigest string) string {
 	safeImageTagOrDigest := url.QueryEscape(imageTagOrDigest)
 	if safeImageTagOrDigest == "" || safeImageTagOrDigest == "." || safeImageTagOrDigest == ".." {
@@ -193,15 +295,19 @@ func cachedIndexFilename(imageName, imageTagOrDigest string) string {
 	return fmt.Sprint(cachedImageDirectory(imageName), "/indexes/", safeImageTagOrDigest, "/index.json")
 }
 
+func cachedRevalidatedFilename(imageName, imageTag string) string {
+	return fmt.Sprint(filepath.Dir(cachedIndexFilename(imageName, imageTag)), "/revalidated")
+}
+
 func cachedBlobFilenameForSha256(imageName, sha256 string) string {
 	return fmt.Sprint(cachedImageDirectory(imageName), "/blobs/sha256/", sha256)
 }
 
-func openCachedBlobForSha256(imageName, sha256 string) (io.Reader, error) {
+func openCachedBlobForSha256(imageName, sha256 string) (io.ReadCloser, error) {
 	cachePath := cachedBlobFilenameForSha256(imageName, sha256)
 	file, err := os.Open(cachePath)
 	// if err == nil {
-	// 	log.Print("Found ", cachePath)
+	// 	slog.Debug("Found", "path", cachePath)
 	// }
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, nil
@@ -210,20 +316,32 @@ func openCachedBlobForSha256(imageName, sha256 string) (io.Reader, error) {
 }
 
 func copyToFile(filename string, reader io.Reader) (int64, error) {
+	tempName, bytesWritten, err := writeTempFile(filename, reader)
+	if err != nil {
+		return bytesWritten, err
+	}
+	return bytesWritten, renameTempFile(tempName, filename)
+}
+
+// writeTempFile writes to a temp file next to filename, to be moved into place
+// with renameTempFile.
+func writeTempFile(filename string, reader io.Reader) (string, int64, error) {
 	// ensure directory exists
 	err := os.MkdirAll(filepath.Dir(filename), 0777)
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
 
 	// make temp file
-	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename))
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+tempFilePattern)
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
+	tempFiles.Store(f.Name(), true)
 	defer func() {
 		if err != nil {
 			_ = os.Remove(f.Name())
+			tempFiles.Delete(f.Name())
 		}
 	}()
 	defer f.Close()
@@ -232,19 +350,63 @@ func copyToFile(filename string, reader io.Reader) (int64, error) {
 	var bytesWritten int64
 	bytesWritten, err = io.Copy(f, reader)
 	if err != nil {
-		return bytesWritten, err
+		return "", bytesWritten, err
 	}
 	if err = f.Sync(); err != nil {
-		return bytesWritten, err
+		return "", bytesWritten, err
 	}
 	if err = f.Close(); err != nil {
-		return bytesWritten, err
+		return "", bytesWritten, err
 	}
+	return f.Name(), bytesWritten, nil
+}
 
-	// rename to actual filename
+// renameTempFile moves a temp file from writeTempFile into place, or removes it
+// if that fails.
+func renameTempFile(tempName, filename string) error {
+	defer tempFiles.Delete(tempName)
 	// TODO: this is not guaranteed to be atomic on non-Unix platforms
-	err = os.Rename(f.Name(), filename)
-	return bytesWritten, err
+	err := os.Rename(tempName, filename)
+	if err != nil {
+		_ = os.Remove(tempName)
+	}
+	return err
+}
+
+// writeBlob writes a blob into the cache unless it's already there, and reports
+// whether it did. Blobs can be large and slow to read, so the blobs lock is only
+// held to check whether the blob exists and to move it into place, letting other
+// references to the image write their blobs in the meantime.
+func writeBlob(ctx context.Context, imageName, shasum string, reader io.Reader) (int64, bool, error) {
+	cachePath := cachedBlobFilenameForSha256(imageName, shasum)
+	blobExists := func() (any, error) {
+		return fileExists(cachePath)
+	}
+	exists, err := withCacheLock(ctx, imageName, blobsLockName, blobExists)
+	if err != nil || exists.(bool) {
+		return 0, false, err
+	}
+
+	tempName, bytesWritten, err := writeTempFile(cachePath, reader)
+	if err != nil {
+		return bytesWritten, false, err
+	}
+	written, err := withCacheLock(ctx, imageName, blobsLockName, func() (any, error) {
+		exists, err := fileExists(cachePath)
+		if err != nil || exists {
+			return false, err
+		}
+		return true, renameTempFile(tempName, cachePath)
+	})
+	if written == nil || !written.(bool) {
+		// another export or push got there first, or something went wrong
+		_ = os.Remove(tempName)
+		tempFiles.Delete(tempName)
+	}
+	if err != nil {
+		return bytesWritten, false, err
+	}
+	return bytesWritten, written.(bool), nil
 }
 
 func fileExists(filename string) (bool, error) {
@@ -258,7 +420,7 @@ func fileExists(filename string) (bool, error) {
 	return false, err
 }
 
-func saveOciImageToCache(imageName string, imageTagOrDigest string, tarball *tar.Reader) error {
+func saveOciImageToCache(ctx context.Context, imageName string, imageTagOrDigest string, tarball *tar.Reader) error {
 	for {
 		header, err := tarball.Next()
 		if err == io.EOF {
@@ -272,24 +434,26 @@ func saveOciImageToCache(imageName string, imageTagOrDigest string, tarball *tar
 		}
 
 		if strings.HasPrefix(header.Name, "blobs/") {
-			// blobs get written directly
-			cachePath := fmt.Sprint(cachedImageDirectory(imageName), "/", header.Name)
-			exists, err := fileExists(cachePath)
+			// blobs get written directly, unless another reference to the same
+			// image that shares them already has.
+			shasum := strings.TrimPrefix(header.Name, "blobs/sha256/")
+			if shasum == header.Name || shasum == "" {
+				slog.DebugContext(ctx, "Ignoring file", "file", header.Name)
+				continue
+			}
+			bytesWritten, written, err := writeBlob(ctx, imageName, shasum, tarball)
 			if err != nil {
 				return err
 			}
-			if exists {
-				log.Printf("Skipping %s %s", imageName, header.Name)
+			if written {
+				slog.DebugContext(ctx, "Wrote blob", "file", header.Name, "bytes", bytesWritten)
 			} else {
-				bytesWritten, err := copyToFile(cachePath, tarball)
-				if err != nil {
-					return err
-				}
-				log.Printf("Wrote %s %s (%d bytes)", imageName, header.Name, bytesWritten)
+				slog.DebugContext(ctx, "Skipping existing blob", "file", header.Name)
 			}
-		} else if header.Name == "index.json" && !strings.HasPrefix(imageTagOrDigest, "sha256:") {
-			// index files get written to a directory depending on the image tag
-			// if the image is being referenced by digest, though, we don't care
+		} else if header.Name == "index.json" {
+			// index files get written to a directory depending on the image tag.
+			// images referenced by digest are served straight from their blobs, but
+			// still get an index so garbage collection knows the blobs are in use.
 			content, err := io.ReadAll(tarball)
 			if err != nil {
 				return err
@@ -300,14 +464,21 @@ func saveOciImageToCache(imageName string, imageTagOrDigest string, tarball *tar
 			if err != nil {
 				return err
 			}
-			log.Printf("Wrote %s/%s %s (%d bytes)", imageName, imageTagOrDigest, header.Name, bytesWritten)
+			slog.DebugContext(ctx, "Wrote index", "file", header.Name, "bytes", bytesWritten)
+			negativeCache.Forget(imageName, imageTagOrDigest)
+
+			// whatever we last revalidated doesn't apply to the new index
+			err = os.Remove(cachedRevalidatedFilename(imageName, imageTagOrDigest))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
 		} else {
-			log.Printf("Ignoring %s/%s %s", imageName, imageTagOrDigest, header.Name)
+			slog.DebugContext(ctx, "Ignoring file", "file", header.Name)
 		}
 	}
 }
 
-func checkManifestAndReferencedBlobsExist(imageName, shasum string) (bool, error) {
+func checkManifestAndReferencedBlobsExist(ctx context.Context, imageName, shasum string) (bool, error) {
 	// This function exists because Docker can sometimes return images with manifests
 	// but no blobs! See https://github.com/ligfx/k3d-registry-dockerd/issues/13
 	// and https://github.com/moby/moby/issues/49473
@@ -333,7 +504,7 @@ func checkManifestAndReferencedBlobsExist(imageName, shasum string) (bool, error
 				return false, err
 			}
 			if exists {
-				ok, err := checkManifestAndReferencedBlobsExist(imageName, m.Digest.Encoded())
+				ok, err := checkManifestAndReferencedBlobsExist(ctx, imageName, m.Digest.Encoded())
 				if err != nil {
 					return false, err
 				}
@@ -375,45 +546,330 @@ func checkManifestAndReferencedBlobsExist(imageName, shasum string) (bool, error
 		}
 
 		if len(missingDigests) > 0 {
-			log.Printf("Manifest %s@sha256:%s missing blobs: %v", imageName, shasum, missingDigests)
+			slog.WarnContext(ctx, "Manifest missing blobs", "manifest", fmt.Sprint("sha256:", shasum), "missing", missingDigests)
 			return false, nil
 		}
 		return true, nil
 	}
 
 	// for any other file type, if it exists assume we're okay
-	log.Printf("checkManifestAndReferencedBlobsExist %s %s unknown media type %s", imageName, shasum, mt.MediaType)
+	slog.DebugContext(ctx, "checkManifestAndReferencedBlobsExist unknown media type", "manifest", fmt.Sprint("sha256:", shasum), "media_type", mt.MediaType)
 	return true, nil
 }
 
-var imageMutexPool KeyedMutexPool
+func removeBlobAndReferences(ctx context.Context, imageName, shasum string) error {
+	// removes a blob along with every manifest, manifest list, and tag index
+	// that references it, either directly or through other manifests. the next
+	// request for any of those will then export the image again from Docker.
+	err := os.Remove(cachedBlobFilenameForSha256(imageName, shasum))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	slog.InfoContext(ctx, "Removed blob", "file", fmt.Sprint("blobs/sha256/", shasum))
 
-func ensureImageInCache(ctx context.Context, imageName, imageTagOrDigest string, auth *ImageAuthConfig) (bool, error) {
-	found, err := imageMutexPool.Do(imageName, func() (any, error) {
-		// check if we have either the index for a tag, or the blob for a digest
-		var cachePath string
-		if strings.HasPrefix(imageTagOrDigest, "sha256:") {
-			cachePath = cachedBlobFilenameForSha256(imageName, strings.TrimPrefix(imageTagOrDigest, "sha256:"))
-		} else {
-			cachePath = cachedIndexFilename(imageName, imageTagOrDigest)
+	// manifests are small JSON files, so find them by trying to parse every blob
+	// below the maximum manifest size that the distribution spec allows. keep going
+	// until we stop finding manifests that reference something we've removed.
+	removed := map[string]bool{shasum: true}
+	blobsDirectory := fmt.Sprint(cachedImageDirectory(imageName), "/blobs/sha256")
+	for {
+		entries, err := os.ReadDir(blobsDirectory)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
-		exists, err := fileExists(cachePath)
+		removedAny := false
+		for _, entry := range entries {
+			if removed[entry.Name()] || isTempFile(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() || info.Size() > maxManifestSize {
+				continue
+			}
+			references, err := manifestReferencesAnyOf(cachedBlobFilenameForSha256(imageName, entry.Name()), removed)
+			if err != nil || !references {
+				continue
+			}
+			err = os.Remove(cachedBlobFilenameForSha256(imageName, entry.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			slog.InfoContext(ctx, "Removed manifest", "file", fmt.Sprint("blobs/sha256/", entry.Name()))
+			removed[entry.Name()] = true
+			removedAny = true
+		}
+		if !removedAny {
+			break
+		}
+	}
+
+	// and finally remove any tags pointing at removed manifests.
+	indexFilenames, err := filepath.Glob(fmt.Sprint(cachedImageDirectory(imageName), "/indexes/*/index.json"))
+	if err != nil {
+		return err
+	}
+	for _, indexFilename := range indexFilenames {
+		references, err := manifestReferencesAnyOf(indexFilename, removed)
 		if err != nil {
-			return false, nil
+			slog.WarnContext(ctx, "Error checking index", "path", indexFilename, "error", err)
+			continue
 		}
-		if exists {
+		if !references {
+			continue
+		}
+		err = os.Remove(indexFilename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		tag, _ := url.QueryUnescape(filepath.Base(filepath.Dir(indexFilename)))
+		slog.InfoContext(ctx, "Removed index", "tag", tag)
+	}
+	return nil
+}
+
+func manifestReferencesAnyOf(filename string, shasums map[string]bool) (bool, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	mt, err := ParseMediaTypedBytes(content)
+	if err != nil {
+		return false, err
+	}
+
+	// index.json files written by handleManifestUpload don't have a mediaType, so
+	// treat anything without one as an index too.
+	if IsIndexType(mt.MediaType) || mt.MediaType == "" {
+		index, err := ParseIndexBytes(content)
+		if err != nil {
+			return false, err
+		}
+		for _, m := range index.Manifests {
+			if shasums[m.Digest.Encoded()] {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if IsManifestType(mt.MediaType) {
+		manifest, err := ParseManifestBytes(content)
+		if err != nil {
+			return false, err
+		}
+		if shasums[manifest.Config.Digest.Encoded()] {
 			return true, nil
 		}
+		for _, layer := range manifest.Layers {
+			if shasums[layer.Digest.Encoded()] {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, nil
+}
 
-		// otherwise, find and export the image
-		return findAndExportImage(ctx, imageName, imageTagOrDigest, auth)
+var cacheMutexPool KeyedMutexPool
+
+func withCacheLock(ctx context.Context, imageName, lockName string, f func() (any, error)) (any, error) {
+	// locks are taken either for a single image reference (a tag or digest) while
+	// exporting it, or for all of an image's blobs while writing a single blob.
+	// withImageLock takes all of them.
+	// KeyedMutexPool serializes goroutines in this process, and then the file lock
+	// serializes against other processes sharing the same cache directory.
+	filename := cachedLockFilename(imageName, lockName)
+	// the span only covers waiting for the lock, so it ends once the file is
+	// locked, or when Do gives up waiting without calling this at all.
+	spanCtx, span := startSpan(ctx, "wait for cache lock", attribute.String("image", imageName), attribute.String("lock", lockName))
+	spanEnded := false
+	result, err := cacheMutexPool.Do(spanCtx, filename, func() (any, error) {
+		lock, err := LockFile(filename)
+		endSpan(span, err)
+		spanEnded = true
+		if err != nil {
+			return nil, fmt.Errorf("error locking %s %s: %w", imageName, lockName, err)
+		}
+		defer func() {
+			if err := lock.Unlock(); err != nil {
+				slog.ErrorContext(ctx, "Error unlocking", "image", imageName, "lock", lockName, "error", err)
+			}
+		}()
+		return f()
 	})
-	return found.(bool), err
+	if !spanEnded {
+		endSpan(span, err)
+	}
+	return result, err
+}
+
+// withImageLock takes every lock for an image, for operations which remove parts
+// of it that references share, like blobs or the whole image directory. Exports
+// and pushes in progress may be counting on blobs that already existed, so these
+// wait for them to finish. References are locked in sorted order before the
+// blobs lock, which is also the order exports take them in, so this can't
+// deadlock with them or with itself.
+func withImageLock(ctx context.Context, imageName string, f func() (any, error)) (any, error) {
+	references, err := lockedReferences(imageName)
+	if err != nil {
+		return nil, err
+	}
+	locked := func() (any, error) {
+		return withCacheLock(ctx, imageName, blobsLockName, f)
+	}
+	for i := len(references) - 1; i >= 0; i-- {
+		reference, inner := references[i], locked
+		locked = func() (any, error) {
+			return withCacheLock(ctx, imageName, reference, inner)
+		}
+	}
+	return locked()
+}
+
+// lockedReferences returns the tags and digests of an image which are cached, or
+// which have been locked to export or push them, sorted.
+func lockedReferences(imageName string) ([]string, error) {
+	references, err := cachedTags(imageName)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Dir(cachedLockFilename(imageName, blobsLockName)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".lock")
+		if !ok {
+			continue
+		}
+		reference, err := url.QueryUnescape(name)
+		if err != nil || reference == blobsLockName || slices.Contains(references, reference) {
+			continue
+		}
+		references = append(references, reference)
+	}
+	slices.Sort(references)
+	return references, nil
+}
+
+// coalesces concurrent requests for the same image reference and credentials, so
+// that they share a single export rather than each waiting to redo it.
+var imageExportPool KeyedMutexPool
+
+// owned by the server rather than any single request, so that pulls and exports
+// keep going after the request that started them goes away. cancelled when
+// shutting down.
+var serverContext, cancelServerContext = context.WithCancel(context.Background())
+
+// remembers not found and unauthorized results for the negative cache TTL
+var negativeCache NegativeCache
+
+func ensureImageInCache(ctx context.Context, imageName, imageTagOrDigest string, auth *ImageAuthConfig) (found bool, err error) {
+	ctx = WithLogAttrs(ctx, "image", imageName, "reference", imageTagOrDigest)
+	ctx, span := startSpan(ctx, "ensureImageInCache",
+		attribute.String("image", imageName), attribute.String("reference", imageTagOrDigest))
+	defer func() {
+		span.SetAttributes(attribute.Bool("found", found))
+		endSpan(span, err)
+	}()
+
+	// requests with different credentials may get different results, so they
+	// shouldn't share an export.
+	credentials := ""
+	if auth != nil {
+		authsum := sha256.Sum256([]byte(fmt.Sprint(auth.Username, ":", auth.Password)))
+		credentials = hex.EncodeToString(authsum[:])
+	}
+	key := fmt.Sprint(imageName, " ", imageTagOrDigest)
+	if credentials != "" {
+		key = fmt.Sprint(key, " ", credentials)
+	}
+
+	if err := validateReference(imageName, imageTagOrDigest); err != nil {
+		return false, err
+	}
+
+	if cached, err := negativeCache.Get(imageName, imageTagOrDigest, credentials); cached {
+		slog.InfoContext(ctx, "Recently failed to find image, not trying again yet")
+		span.SetAttributes(attribute.Bool("negative_cache_hit", true))
+		return false, err
+	}
+
+	result, shared, err := imageExportPool.DoShared(ctx, key, func() (any, error) {
+		// containerd gives up on slow pulls of large images and tries again later. run
+		// the pull and export on their own context, so they keep going in the meantime
+		// and the retry can pick up the result. they still stop when shutting down.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), currentConfig().PullTimeout)
+		defer cancel()
+		stop := context.AfterFunc(serverContext, cancel)
+		defer stop()
+
+		found, err := withCacheLock(ctx, imageName, imageTagOrDigest, func() (any, error) {
+			// check if we have either the index for a tag, or the blob for a digest
+			var cachePath string
+			if strings.HasPrefix(imageTagOrDigest, "sha256:") {
+				cachePath = cachedBlobFilenameForSha256(imageName, strings.TrimPrefix(imageTagOrDigest, "sha256:"))
+			} else {
+				cachePath = cachedIndexFilename(imageName, imageTagOrDigest)
+			}
+			exists, err := fileExists(cachePath)
+			if err != nil {
+				return false, nil
+			}
+			if exists {
+				// tags may have moved upstream since we exported them, so check
+				// them again if their policy says so.
+				cacheLookupsTotal.WithLabelValues("hit").Inc()
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache_hit", true))
+				if !strings.HasPrefix(imageTagOrDigest, "sha256:") {
+					revalidateCachedTagIfStale(ctx, imageName, imageTagOrDigest, auth)
+				} else {
+					// digests cached by older versions have no index, so garbage
+					// collection would remove them
+					indexExists, err := fileExists(cachedIndexFilename(imageName, imageTagOrDigest))
+					if err == nil && !indexExists {
+						_, err = writeManifestIndex(imageName, imageTagOrDigest, strings.TrimPrefix(imageTagOrDigest, "sha256:"))
+					}
+					if err != nil {
+						slog.WarnContext(ctx, "Error writing index for cached digest", "error", err)
+					}
+				}
+				return true, nil
+			}
+
+			// otherwise, find and export the image
+			cacheLookupsTotal.WithLabelValues("miss").Inc()
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache_hit", false))
+			return findAndExportImage(ctx, imageName, imageTagOrDigest, auth)
+		})
+
+		// remember failures that will keep failing for a while, so that retries
+		// don't go to the upstream registry every time.
+		if err == nil && !found.(bool) {
+			negativeCache.Set(imageName, imageTagOrDigest, credentials, nil, currentConfig().NegativeCacheTTL)
+		} else if err != nil && IsUnauthorizedError(err) {
+			negativeCache.Set(imageName, imageTagOrDigest, credentials, err, currentConfig().NegativeCacheTTL)
+		}
+		return found, err
+	})
+	if shared {
+		slog.InfoContext(ctx, "Shared result of in-progress export")
+		span.SetAttributes(attribute.Bool("shared", true))
+	}
+	if err != nil && ctx.Err() != nil {
+		slog.InfoContext(ctx, "Stopped waiting, but any pull or export will continue in the background", "reason", ctx.Err())
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
 }
 
 func handleBlobUpload(w http.ResponseWriter, req *http.Request) {
 	// get the HTTP arguments
-	name := req.PathValue("name")
+	name, _ := requestImageName(req)
+	path := req.PathValue("name")
 	digest := req.URL.Query().Get("digest")
 
 	// if no digest, this is the two-step upload process. respond with the same
@@ -423,7 +879,12 @@ func handleBlobUpload(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "", http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads", name))
+		location := fmt.Sprintf("/v2/%s/blobs/uploads", path)
+		if ns := req.URL.Query().Get("ns"); ns != "" {
+			// the second step has to be for the same registry
+			location = fmt.Sprint(location, "?ns=", url.QueryEscape(ns))
+		}
+		w.Header().Set("Location", location)
 		w.WriteHeader(http.StatusAccepted)
 		return
 	}
@@ -439,31 +900,81 @@ func handleBlobUpload(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, fmt.Sprintf("don't know how to handle digest %q", digest), http.StatusInternalServerError)
 		return
 	}
+	if err := validateReference(name, digest); err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
 	shasum := strings.TrimPrefix(digest, "sha256:")
-	cachePath := cachedBlobFilenameForSha256(name, shasum)
-	bytesWritten, err := copyToFile(cachePath, req.Body)
+	bytesWritten, written, err := writeBlob(req.Context(), name, shasum, req.Body)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error writing %q: %s", cachePath, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("error writing blob %s: %s", digest, err), http.StatusInternalServerError)
 		return
-	} else {
-		log.Printf("Wrote %s blobs/sha256/%s (%d bytes)", name, shasum, bytesWritten)
+	} else if written {
+		slog.InfoContext(req.Context(), "Wrote uploaded blob", "image", name, "file", fmt.Sprint("blobs/sha256/", shasum), "bytes", bytesWritten)
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", path, digest))
 	// docker push, as used by Tilt (and maybe other tools), requires this header
 	// TODO: actually calculate and check our own digest?
 	w.Header().Set("Docker-Content-Digest", digest)
 	w.WriteHeader(http.StatusCreated)
 }
 
-func handleBlobs(w http.ResponseWriter, req *http.Request) {
-	// get the HTTP arguments
+// requestImageName returns the name of the image a request is for in the cache,
+// and the domain of the registry it comes from. Requests without the ns query
+// parameter are for the proxy remote URL's registry if there is one, or else for
+// pushed images, which have no domain.
+func requestImageName(req *http.Request) (string, string) {
 	name := req.PathValue("name")
-	digest := req.PathValue("digest")
 	domain := req.URL.Query().Get("ns")
+	if domain == "" {
+		domain = currentConfig().proxyDomain
+	}
 	if domain != "" {
 		name = fmt.Sprint(domain, "/", name)
 	}
+	return name, domain
+}
+
+func handleBlobDelete(w http.ResponseWriter, req *http.Request) {
+	name, _ := requestImageName(req)
+	digest := req.PathValue("digest")
+	if !currentConfig().DeleteEnabled {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "deletes are disabled, set -delete-enabled to enable them")
+		return
+	}
+	shasum := strings.TrimPrefix(digest, "sha256:")
+	removed, err := withImageLock(req.Context(), name, func() (any, error) {
+		err := os.Remove(cachedBlobFilenameForSha256(name, shasum))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	if !removed.(bool) {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	slog.InfoContext(req.Context(), "Deleted blob", "image", name, "digest", digest)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleBlobs(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "DELETE" {
+		handleBlobDelete(w, req)
+		return
+	}
+
+	// get the HTTP arguments
+	name, domain := requestImageName(req)
+	digest := req.PathValue("digest")
+	if domain != "" && !checkPrivateImageAuth(w, req, name, domain, "") {
+		return
+	}
 
 	// TODO: check accept header?
 
@@ -477,18 +988,52 @@ func handleBlobs(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	defer blob.Close()
 	if req.Method == "GET" {
-		_, err = io.Copy(w, blob)
+		if !currentConfig().VerifyBlobs || !strings.HasPrefix(digest, "sha256:") {
+			bytesWritten, err := io.Copy(w, blob)
+			bytesServedTotal.WithLabelValues("blob").Add(float64(bytesWritten))
+			if err != nil {
+				http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+				return
+			}
+			return
+		}
+
+		// hash the blob while sending it, so that we notice if the cached copy
+		// has been corrupted somehow.
+		hasher := sha256.New()
+		bytesWritten, err := io.Copy(io.MultiWriter(w, hasher), blob)
+		bytesServedTotal.WithLabelValues("blob").Add(float64(bytesWritten))
 		if err != nil {
 			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 			return
 		}
+		calculated := hex.EncodeToString(hasher.Sum(nil))
+		if calculated != shasum {
+			ctx := WithLogAttrs(req.Context(), "image", name)
+			slog.ErrorContext(ctx,
+				"Cached blob is corrupted. Removing it and any manifests and tags that reference it, so that"+
+					" the image is exported again from Docker on the next pull.",
+				"digest", digest, "calculated_digest", fmt.Sprint("sha256:", calculated))
+			blob.Close()
+			_, err := withImageLock(ctx, name, func() (any, error) {
+				return nil, removeBlobAndReferences(ctx, name, shasum)
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "Error removing corrupted blob", "digest", digest, "error", err)
+			}
+			// the headers and (bad) content have already been sent, so the only way
+			// to tell the client something went wrong is to abort the response.
+			panic(http.ErrAbortHandler)
+		}
 	}
 }
 
 func handleManifestUpload(w http.ResponseWriter, req *http.Request) {
 	// get the HTTP arguments
-	name := req.PathValue("name")
+	name, _ := requestImageName(req)
+	path := req.PathValue("name")
 	tagOrDigest := req.PathValue("tagOrDigest")
 
 	// read the manifest to upload
@@ -502,68 +1047,126 @@ func handleManifestUpload(w http.ResponseWriter, req *http.Request) {
 	shasumbytes := sha256.Sum256(content)
 	shasum := hex.EncodeToString(shasumbytes[:])
 	if strings.HasPrefix(tagOrDigest, "sha256:") && shasum != strings.TrimPrefix(tagOrDigest, "sha256:") {
-		http.Error(w, fmt.Sprint("Mismatched calculated digest %s", shasum), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Mismatched calculated digest %s", shasum), http.StatusBadRequest)
 		return
 	}
 
 	// write manifest as a blob
 	// TODO: what if it already exists?
-	cachePath := cachedBlobFilenameForSha256(name, shasum)
-	bytesWritten, err := copyToFile(cachePath, bytes.NewReader(content))
+	_, err = withCacheLock(req.Context(), name, blobsLockName, func() (any, error) {
+		cachePath := cachedBlobFilenameForSha256(name, shasum)
+		bytesWritten, err := copyToFile(cachePath, bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(req.Context(), "Wrote uploaded manifest", "image", name, "file", fmt.Sprint("blobs/sha256/", shasum), "bytes", bytesWritten)
+		return nil, nil
+	})
 	if err != nil {
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Wrote %s blobs/sha256/%s (%d bytes)", name, shasum, bytesWritten)
 
-	// write index, if necessary
-	if !strings.HasPrefix(tagOrDigest, "sha256:") {
-		indexPath := cachedIndexFilename(name, tagOrDigest)
-		// TODO: write a proper index file
-		indexContent := fmt.Sprintf(`{"manifests":[{"digest":"sha256:%s"}]}`, shasum)
-		bytesWritten, err = copyToFile(indexPath, strings.NewReader(indexContent))
+	// write index. manifests pushed by digest get one too, so that garbage
+	// collection knows they're in use.
+	_, err = withCacheLock(req.Context(), name, tagOrDigest, func() (any, error) {
+		bytesWritten, err := writeManifestIndex(name, tagOrDigest, shasum)
 		if err != nil {
-			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		log.Printf("Wrote %s/%s index.json (%d bytes)", name, tagOrDigest, bytesWritten)
+		slog.InfoContext(req.Context(), "Wrote uploaded index", "image", name, "reference", tagOrDigest, "bytes", bytesWritten)
+		return nil, nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, tagOrDigest))
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", path, tagOrDigest))
 	// docker push, as used by Tilt (and maybe other tools), requires this header
 	w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%s", shasum))
 	w.WriteHeader(http.StatusCreated)
 }
 
+func handleManifestDelete(w http.ResponseWriter, req *http.Request) {
+	name, _ := requestImageName(req)
+	tagOrDigest := req.PathValue("tagOrDigest")
+	if !currentConfig().DeleteEnabled {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "deletes are disabled, set -delete-enabled to enable them")
+		return
+	}
+	ctx := WithLogAttrs(req.Context(), "image", name, "reference", tagOrDigest)
+
+	// deleting a tag only removes the tag, but deleting a manifest also removes
+	// the tags and manifest lists which reference it
+	var removed bool
+	var err error
+	if strings.HasPrefix(tagOrDigest, "sha256:") {
+		var result any
+		result, err = withImageLock(ctx, name, func() (any, error) {
+			shasum := strings.TrimPrefix(tagOrDigest, "sha256:")
+			exists, err := fileExists(cachedBlobFilenameForSha256(name, shasum))
+			if err != nil || !exists {
+				return false, err
+			}
+			return true, removeBlobAndReferences(ctx, name, shasum)
+		})
+		removed, _ = result.(bool)
+	} else {
+		removed, err = PurgeCachedReference(ctx, name, tagOrDigest)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	slog.InfoContext(ctx, "Deleted manifest")
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func handleManifests(w http.ResponseWriter, req *http.Request) {
-	// handle uploads
+	name, _ := requestImageName(req)
+	if err := validateReference(name, req.PathValue("tagOrDigest")); err != nil {
+		code := "TAG_INVALID"
+		if validateReference(name, "latest") != nil {
+			code = "NAME_INVALID"
+		}
+		writeRegistryError(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+
+	// handle uploads and deletes
 	if req.Method == "PUT" {
 		handleManifestUpload(w, req)
 		return
 	}
+	if req.Method == "DELETE" {
+		handleManifestDelete(w, req)
+		return
+	}
 
 	// get the HTTP arguments
-	name := req.PathValue("name")
+	name, domain := requestImageName(req)
 	tagOrDigest := req.PathValue("tagOrDigest")
-	domain := req.URL.Query().Get("ns")
-	if domain != "" {
-		name = fmt.Sprint(domain, "/", name)
-	}
 
 	// export image if we haven't yet
 	if domain != "" {
-		var auth *ImageAuthConfig
-		if username, password, ok := req.BasicAuth(); ok {
-			auth = &ImageAuthConfig{
-				Username: username,
-				Password: password,
-			}
+		if !checkPrivateImageAuth(w, req, name, domain, tagOrDigest) {
+			return
 		}
+		auth := upstreamAuth(req, domain)
 		found, err := ensureImageInCache(req.Context(), name, tagOrDigest, auth)
 		if err != nil {
 			if IsUnauthorizedError(err) {
-				if auth == nil {
-					// only add this header if we don't have already auth, otherwise
+				// with registry authentication, clients' credentials are for
+				// this registry, so there's no point asking for others. the
+				// registry's own fallback credentials don't count, so that clients
+				// can still send theirs.
+				if _, _, ok := req.BasicAuth(); !ok && !currentConfig().registryAuthEnabled() {
+					// only add this header if the client hasn't sent auth, otherwise
 					// k8s will keep spamming requests...
 					// realm value doesn't matter, but can't be empty
 					w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", domain))
@@ -605,6 +1208,7 @@ func handleManifests(w http.ResponseWriter, req *http.Request) {
 
 		// we now have the actual manifest digest, so fall through to the logic to
 		// grab and return it.
+		recordAccess(name, tagOrDigest)
 		tagOrDigest = index.Manifests[0].Digest.String()
 	}
 
@@ -621,6 +1225,7 @@ func handleManifests(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	defer blob.Close()
 
 	// get the file mimetype from the mediaType json field. all OCI manifest
 	// types should have this.
@@ -633,14 +1238,15 @@ func handleManifests(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		// k8s seems to require a valid content-type for manifest files. if it
 		// doesn't get one, containers will be stuck in "creating" forever.
-		http.Error(w, fmt.Sprintf("%w while parsing, not setting Content-Type for: %v",
+		http.Error(w, fmt.Sprintf("%s while parsing, not setting Content-Type for: %v",
 			err, string(content)), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", mt.MediaType)
 
 	if req.Method == "GET" {
-		_, err = w.Write(content)
+		bytesWritten, err := w.Write(content)
+		bytesServedTotal.WithLabelValues("manifest").Add(float64(bytesWritten))
 		if err != nil {
 			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 			return
@@ -649,50 +1255,164 @@ func handleManifests(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
-	// Config taken from CLI args or environment variables
-	defaultAddr := ":5000"
-	environAddrName := "REGISTRY_HTTP_ADDR"
-	addr := flag.String("addr", "", fmt.Sprintf("Address to listen on (default %q, or value of environment variable %s)", defaultAddr, environAddrName))
-	flag.Parse()
-
-	environAddr := os.Getenv(environAddrName)
-
-	if *addr != "" {
-		if environAddr != "" {
-			log.Printf("Ignoring environment variable %s=%q", environAddrName, environAddr)
-		}
-		log.Printf("Using address specified in command line arguments: %q", *addr)
-	} else if environAddr != "" {
-		log.Printf("Using address specified in environment variable %s=%q", environAddrName, environAddr)
-		*addr = environAddr
-	} else {
-		log.Printf("Using default address: %q", defaultAddr)
-		*addr = defaultAddr
+	// the first argument picks a command, but running without one serves, like
+	// before there were commands
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		os.Exit(runServe(args))
+	case "cache":
+		os.Exit(runCacheCommand(args))
+	case "prefetch":
+		os.Exit(runPrefetch(args))
+	case "help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, `Usage: k3d-registry-dockerd [command] [flags]
+
+Commands:
+  serve    Run the registry (the default)
+  cache    Inspect and maintain the cache directory without running the registry
+  prefetch Get images into the cache without running the registry
+
+Run "k3d-registry-dockerd <command> -h" for the flags of each command.
+`)
+}
+
+const defaultAddr = ":5000"
+const environAddrName = "REGISTRY_HTTP_ADDR"
+
+func runServe(args []string) int {
+	// Config taken from CLI args, the config files, or environment variables. the
+	// flags are parsed once here for -h and -config, and then again by LoadConfig
+	// on top of the config files. like the official registry, a config.yml may be
+	// given after the flags.
+	var configPath string
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	defaultConfig().registerFlags(flags)
+	registerConfigFlag(flags, &configPath)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: k3d-registry-dockerd serve [flags] [<config.yml>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	distributionConfigPath := flags.Arg(0)
+
+	cfg, err := LoadConfig(configPath, distributionConfigPath, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	activeConfig.Store(cfg)
+	CACHE_DIRECTORY = cfg.CacheDir
+
+	logLevel.Set(cfg.LogLevel)
+	logHandler, err := NewLogHandler(os.Stderr, &logLevel, cfg.LogFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(slog.New(logHandler))
+	if distributionConfigPath != "" {
+		slog.Info("Using registry config file", "config", distributionConfigPath)
 	}
+	if configPath != "" {
+		slog.Info("Using config file", "config", configPath)
+	}
+
+	addr := cfg.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	logConfig(context.Background(), cfg)
+	removeStaleTempFiles(context.Background(), CACHE_DIRECTORY, gcMinBlobAge)
 
-	// test docker client
-	ctx := context.Background()
-	info, err := DockerGetInfo(ctx)
+	// background work stops on the first SIGTERM or SIGINT, and a second one
+	// exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	shutdownTracing, err := SetupTracing(ctx, cfg.OTLPEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Error setting up tracing", "error", err)
+		return 1
 	}
-	log.Printf("Connected to Docker API v%s at %s ServerVersion=%s ServerOSType=%s ServerArchitecture=%s",
-		info.ApiVersion,
-		info.DaemonHost,
-		info.ServerVersion,
-		info.ServerOSType,
-		info.ServerArchitecture)
+	defer shutdownTracing(context.Background())
+
+	// test docker client, but don't wait for it. Docker may not have started yet,
+	// and /readyz will report when it does.
+	dockerConnected := waitForDocker(ctx)
+	watchConfigFile(ctx, configPath, distributionConfigPath, args)
+	warmCache(ctx, dockerConnected)
+	exportAllLocalImages(ctx, dockerConnected)
+	watchDockerImageTags(ctx, dockerConnected)
 
 	// the actual HTTP server
 	// uses custom routing because image names may contain slashes / multiple path segments!
 	// TODO: check HTTP method is GET or HEAD
 	mux := NewRegexpServeMux()
-	mux.HandleFunc("^/$", handleHelloWorld)
-	mux.HandleFunc("^/v2/$", handleV2)
-	mux.HandleFunc("^/v2/(?P<name>.+)/blobs/uploads", handleBlobUpload)
-	mux.HandleFunc("^/v2/(?P<name>.+)/blobs/(?P<digest>[^/]+)$", handleBlobs)
-	mux.HandleFunc("^/v2/(?P<name>.+)/manifests/(?P<tagOrDigest>[^/]+)$", handleManifests)
-	log.Printf("Listening on %s", *addr)
-	err = http.ListenAndServe(*addr, LoggingMiddleware(mux))
-	log.Fatal(err)
+	mux.Handle("^/$", InstrumentRoute("status", handleStatusPage))
+	mux.Handle("^/metrics$", promhttp.Handler())
+	mux.Handle("^/healthz$", InstrumentRoute("healthz", handleHealthz))
+	mux.Handle("^/readyz$", InstrumentRoute("readyz", handleReadyz))
+	mux.Handle("^/admin/images$", RequireAdminToken(InstrumentRoute("admin_images", handleAdminImages)))
+	mux.Handle("^/admin/images/(?P<name>.+)/tags/(?P<tag>[^/]+)/export$", RequireAdminToken(InstrumentRoute("admin_tag_export", handleAdminTagExport)))
+	mux.Handle("^/admin/images/(?P<name>.+)/tags/(?P<tag>[^/]+)$", RequireAdminToken(InstrumentRoute("admin_tag", handleAdminTag)))
+	mux.Handle("^/admin/images/(?P<name>.+)$", RequireAdminToken(InstrumentRoute("admin_image", handleAdminImage)))
+	mux.Handle("^/admin/gc$", RequireAdminToken(InstrumentRoute("admin_gc", handleAdminGC)))
+	mux.Handle("^/token$", InstrumentRoute("token", handleToken))
+	mux.Handle("^/v2/$", RequireRegistryAuth(InstrumentRoute("v2", handleV2)))
+	mux.Handle("^/v2/(?P<name>.+)/blobs/uploads", RequireRegistryAuth(InstrumentRoute("blob_uploads", handleBlobUpload)))
+	mux.Handle("^/v2/(?P<name>.+)/blobs/(?P<digest>[^/]+)$", RequireRegistryAuth(InstrumentRoute("blobs", handleBlobs)))
+	mux.Handle("^/v2/(?P<name>.+)/manifests/(?P<tagOrDigest>[^/]+)$", RequireRegistryAuth(InstrumentRoute("manifests", handleManifests)))
+	certFile, keyFile := cfg.TLSCertificate, cfg.TLSKey
+	if cfg.TLSGenerate {
+		hosts := append(defaultTLSHosts(), cfg.TLSHosts...)
+		paths, generated, err := EnsureGeneratedCertificate(hosts)
+		if err != nil {
+			slog.Error("Error generating TLS certificate", "error", err)
+			return 1
+		}
+		if generated {
+			slog.Info("Generated TLS certificate", "hosts", hosts)
+		}
+		// clients need to trust the CA, so make it easy to find
+		slog.Info("Serving HTTPS with a certificate from a self-signed CA. Add the CA to the trusted certificates of clients", "ca_cert", paths.CACertificate)
+		certFile, keyFile = paths.Certificate, paths.Key
+	}
+	server := &http.Server{Addr: addr, Handler: LoggingMiddleware(mux)}
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			slog.Info("Listening with TLS", "addr", addr, "tls_cert", certFile)
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			slog.Info("Listening", "addr", addr)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		slog.Error("Error serving HTTP", "error", err)
+		return 1
+	case <-ctx.Done():
+		stop()
+		shutdownServer(server)
+		return 0
+	}
 }
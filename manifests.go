@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// kubernetesObject is the part of a Kubernetes object needed to find the images
+// it runs. Everything else is ignored.
+type kubernetesObject struct {
+	Kind  string             `yaml:"kind"`
+	Items []kubernetesObject `yaml:"items"`
+	Spec  struct {
+		podSpec `yaml:",inline"`
+		// Deployment, StatefulSet, DaemonSet, ReplicaSet, ReplicationController, Job
+		Template struct {
+			Spec podSpec `yaml:"spec"`
+		} `yaml:"template"`
+		// CronJob
+		JobTemplate struct {
+			Spec struct {
+				Template struct {
+					Spec podSpec `yaml:"spec"`
+				} `yaml:"template"`
+			} `yaml:"spec"`
+		} `yaml:"jobTemplate"`
+	} `yaml:"spec"`
+}
+
+type podSpec struct {
+	Containers          []container `yaml:"containers"`
+	InitContainers      []container `yaml:"initContainers"`
+	EphemeralContainers []container `yaml:"ephemeralContainers"`
+}
+
+type container struct {
+	Image string `yaml:"image"`
+}
+
+func (spec podSpec) images() []string {
+	var images []string
+	for _, containers := range [][]container{spec.InitContainers, spec.Containers, spec.EphemeralContainers} {
+		for _, c := range containers {
+			if c.Image != "" {
+				images = append(images, c.Image)
+			}
+		}
+	}
+	return images
+}
+
+func (object kubernetesObject) images() []string {
+	switch object.Kind {
+	case "Pod":
+		return object.Spec.podSpec.images()
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return object.Spec.Template.Spec.images()
+	case "CronJob":
+		return object.Spec.JobTemplate.Spec.Template.Spec.images()
+	case "List":
+		var images []string
+		for _, item := range object.Items {
+			images = append(images, item.images()...)
+		}
+		return images
+	default:
+		return nil
+	}
+}
+
+// ImagesFromManifests reads Kubernetes objects from a stream of YAML (or JSON)
+// documents, like kustomize or Helm output, and returns the images they run.
+func ImagesFromManifests(r io.Reader) ([]string, error) {
+	var images []string
+	decoder := yaml.NewDecoder(r)
+	for {
+		var object kubernetesObject
+		err := decoder.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			return images, nil
+		}
+		// documents which aren't shaped like Kubernetes objects still decode as
+		// much as possible, so only give up on invalid YAML
+		var typeErr *yaml.TypeError
+		if err != nil && !errors.As(err, &typeErr) {
+			return images, err
+		}
+		images = append(images, object.images()...)
+	}
+}
+
+// ImagesFromManifestPath reads images from a YAML file, every YAML file in a
+// directory and its subdirectories, or stdin if path is "-".
+func ImagesFromManifestPath(path string) ([]string, error) {
+	if path == "-" {
+		return ImagesFromManifests(os.Stdin)
+	}
+
+	var images []string
+	err := filepath.WalkDir(path, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// files given directly are read whatever they're called, but only pick up
+		// YAML files from directories
+		ext := strings.ToLower(filepath.Ext(filename))
+		if filename != path && ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			return nil
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fileImages, err := ImagesFromManifests(f)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", filename, err)
+		}
+		images = append(images, fileImages...)
+		return nil
+	})
+	return images, err
+}
+
+// normalizeImageList normalizes image references the same way the registry names
+// images in Docker, so that "nginx", "nginx:latest", and "docker.io/library/nginx"
+// are all "nginx:latest", and removes duplicates.
+func normalizeImageList(refs []string) ([]string, error) {
+	var images []string
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		name, tagOrDigest, err := ParseImageReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image %q: %w", ref, err)
+		}
+		if tagOrDigest == "" {
+			tagOrDigest = "latest"
+		}
+		image := dockerImageReference(name, tagOrDigest)
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "k3d_registry_dockerd"
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method, and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by route, method, and status code.",
+		Buckets:   []float64{.005, .025, .1, .5, 1, 5, 15, 60, 300, 900},
+	}, []string{"route", "method", "code"})
+
+	cacheLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Image references looked up in the cache, by whether they were already cached (hit) or had to be exported from Docker (miss).",
+	}, []string{"result"})
+
+	bytesServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_served_total",
+		Help:      "Bytes of blobs and manifests sent to clients.",
+	}, []string{"type"})
+
+	dockerOperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_operations_total",
+		Help:      "Docker pulls, exports, and BuildKit repairs, by whether they succeeded.",
+	}, []string{"operation", "result"})
+
+	dockerOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_operation_duration_seconds",
+		Help:      "Time taken by Docker pulls, exports, and BuildKit repairs.",
+		Buckets:   []float64{.1, .5, 1, 5, 15, 30, 60, 120, 300, 900, 1800},
+	}, []string{"operation"})
+
+	missingBlobDetectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_blob_detections_total",
+		Help:      "Exported images found to be missing blobs, by known issue: \"digest\" (ligfx/k3d-registry-dockerd#14) or \"layers\" (ligfx/k3d-registry-dockerd#13).",
+	}, []string{"issue"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lock_waiters",
+		Help:      "Goroutines currently waiting for a cache lock held by another goroutine.",
+	}, func() float64 {
+		return float64(cacheMutexPool.Stats().Waiting)
+	})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lock_wait_seconds_total",
+		Help:      "Total time spent waiting for cache locks.",
+	}, func() float64 {
+		return cacheMutexPool.Stats().TotalWaitTime.Seconds()
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "exports_in_progress",
+		Help:      "Image pulls and exports currently in progress.",
+	}, func() float64 {
+		return float64(imageExportPool.Stats().Running)
+	})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exports_shared_total",
+		Help:      "Requests which shared the result of an export already in progress for another request.",
+	}, func() float64 {
+		return float64(imageExportPool.Stats().TotalShared)
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_disk_usage_bytes",
+		Help:      "Total size of files in the cache directory.",
+	}, cacheDiskUsage.Bytes)
+)
+
+// InstrumentRoute wraps handler so that its requests are counted and timed under
+// the given route name.
+func InstrumentRoute(route string, handler http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerCounter(httpRequestsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels), handler))
+}
+
+// observeDockerOperation records the result and duration of a Docker operation
+// which started at startTime.
+func observeDockerOperation(operation string, startTime time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	dockerOperationsTotal.WithLabelValues(operation, result).Inc()
+	dockerOperationDuration.WithLabelValues(operation).Observe(time.Since(startTime).Seconds())
+}
+
+// walking the whole cache directory can be slow, so only do it every so often
+// rather than on every scrape.
+var cacheDiskUsage = diskUsageCache{maxAge: 30 * time.Second}
+
+type diskUsageCache struct {
+	mu        sync.Mutex
+	maxAge    time.Duration
+	updatedAt time.Time
+	bytes     float64
+}
+
+func (cache *diskUsageCache) Bytes() float64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if time.Since(cache.updatedAt) < cache.maxAge {
+		return cache.bytes
+	}
+
+	var total int64
+	_ = filepath.WalkDir(CACHE_DIRECTORY, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && path != CACHE_DIRECTORY {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	cache.bytes = float64(total)
+	cache.updatedAt = time.Now()
+	return cache.bytes
+}
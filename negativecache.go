@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// NegativeCache remembers image lookups which recently turned out to be not found
+// or unauthorized, so that clients retrying them don't cause repeated requests to
+// the upstream registry (and use up its rate limits) until the entry expires.
+//
+// Lookups with different credentials may get different results, so entries are
+// kept per credentials, but grouped by image reference so that all of them can be
+// forgotten at once when the image turns up.
+type NegativeCache struct {
+	mu      sync.Mutex
+	entries map[negativeCacheReference]map[string]negativeCacheEntry
+}
+
+type negativeCacheReference struct {
+	imageName        string
+	imageTagOrDigest string
+}
+
+type negativeCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// Get returns whether a reference was recently looked up with credentials, which
+// identifies them like a hash or is "" for none, without success, along with the
+// error if it failed with one. A nil error means the image wasn't found.
+func (cache *NegativeCache) Get(imageName, imageTagOrDigest, credentials string) (bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	ref := negativeCacheReference{imageName, imageTagOrDigest}
+	entry, ok := cache.entries[ref][credentials]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries[ref], credentials)
+		if len(cache.entries[ref]) == 0 {
+			delete(cache.entries, ref)
+		}
+		return false, nil
+	}
+	return true, entry.err
+}
+
+// Set remembers that a reference was looked up with credentials without success
+// for the next ttl.
+func (cache *NegativeCache) Set(imageName, imageTagOrDigest, credentials string, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[negativeCacheReference]map[string]negativeCacheEntry)
+	}
+	// clear out anything expired while we're here, so the map doesn't grow forever
+	now := time.Now()
+	for ref, variants := range cache.entries {
+		for credentials, entry := range variants {
+			if now.After(entry.expires) {
+				delete(variants, credentials)
+			}
+		}
+		if len(variants) == 0 {
+			delete(cache.entries, ref)
+		}
+	}
+	ref := negativeCacheReference{imageName, imageTagOrDigest}
+	if cache.entries[ref] == nil {
+		cache.entries[ref] = make(map[string]negativeCacheEntry)
+	}
+	cache.entries[ref][credentials] = negativeCacheEntry{err, now.Add(ttl)}
+}
+
+// Forget removes a reference, whatever credentials it was looked up with, so the
+// next lookup goes ahead even if it recently failed.
+func (cache *NegativeCache) Forget(imageName, imageTagOrDigest string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, negativeCacheReference{imageName, imageTagOrDigest})
+}
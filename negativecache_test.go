@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheForget(t *testing.T) {
+	unauthorized := errors.New("unauthorized")
+	tests := []struct {
+		name             string
+		imageName        string
+		imageTagOrDigest string
+		credentials      string
+		err              error
+		forgotten        bool
+	}{
+		{"without credentials", "docker.io/myapp", "latest", "", nil, true},
+		{"with credentials", "docker.io/myapp", "latest", "abc123", unauthorized, true},
+		{"with other credentials", "docker.io/myapp", "latest", "def456", nil, true},
+		{"other tag", "docker.io/myapp", "v1", "abc123", nil, false},
+		{"other image", "docker.io/myapp-dev", "latest", "", nil, false},
+	}
+
+	var cache NegativeCache
+	for _, test := range tests {
+		cache.Set(test.imageName, test.imageTagOrDigest, test.credentials, test.err, time.Minute)
+	}
+	for _, test := range tests {
+		cached, err := cache.Get(test.imageName, test.imageTagOrDigest, test.credentials)
+		if !cached || err != test.err {
+			t.Errorf("%s: Get() = %v, %v, want true, %v", test.name, cached, err, test.err)
+		}
+	}
+
+	cache.Forget("docker.io/myapp", "latest")
+	for _, test := range tests {
+		cached, _ := cache.Get(test.imageName, test.imageTagOrDigest, test.credentials)
+		if cached == test.forgotten {
+			t.Errorf("%s: Get() after Forget() = %v, want %v", test.name, cached, !test.forgotten)
+		}
+	}
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	var cache NegativeCache
+	cache.Set("docker.io/myapp", "latest", "", nil, 0)
+	if cached, _ := cache.Get("docker.io/myapp", "latest", ""); cached {
+		t.Error("Get() = true with a ttl of 0, want nothing cached")
+	}
+	cache.Set("docker.io/myapp", "latest", "", nil, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if cached, _ := cache.Get("docker.io/myapp", "latest", ""); cached {
+		t.Error("Get() = true after the entry expired")
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("expired entries are still kept: %v", cache.entries)
+	}
+}
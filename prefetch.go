@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/distribution/reference"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ParseImageReference normalizes an image reference like Docker does, so "nginx"
+// is "docker.io/library/nginx", and splits it into the image name used in the
+// cache and its tag or digest, which is empty if the reference has neither.
+func ParseImageReference(ref string) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", err
+	}
+	name := fmt.Sprint(reference.Domain(named), "/", reference.Path(named))
+	if digested, ok := named.(reference.Digested); ok {
+		return name, digested.Digest().String(), nil
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return name, tagged.Tag(), nil
+	}
+	return name, "", nil
+}
+
+// PrefetchResult is the outcome of prefetching a single image.
+type PrefetchResult struct {
+	Reference string
+	Duration  time.Duration
+	Err       error
+}
+
+// PrefetchImages gets each image into the cache, the same way as if it had been
+// requested by a client, running up to concurrency at once. report is called with
+// the result of each image as it finishes. It returns the number that failed.
+func PrefetchImages(ctx context.Context, refs []string, concurrency int, report func(PrefetchResult)) int {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	sem := make(chan struct{}, max(concurrency, 1))
+	for _, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			startTime := time.Now()
+			err := prefetchImage(ctx, ref)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			}
+			report(PrefetchResult{ref, time.Since(startTime), err})
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+func prefetchImage(ctx context.Context, ref string) error {
+	name, tagOrDigest, err := ParseImageReference(ref)
+	if err != nil {
+		return err
+	}
+	if tagOrDigest == "" {
+		tagOrDigest = "latest"
+	}
+	ctx = WithLogAttrs(ctx, "prefetch", ref)
+	found, err := ensureImageInCache(ctx, name, tagOrDigest, nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("image not found")
+	}
+	return nil
+}
+
+const environWarmImagesName = "K3D_REGISTRY_WARM_IMAGES"
+
+// parseImageList splits a list of images separated by commas or whitespace.
+func parseImageList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// progress of prefetching warm images, reported by /readyz
+var warmImagesTotal, warmImagesDone atomic.Int64
+
+// warmCache prefetches the warm images in the background once Docker is reachable.
+func warmCache(ctx context.Context, dockerConnected <-chan struct{}) {
+	warmImages, warmConcurrency := currentConfig().WarmImages, currentConfig().WarmConcurrency
+	if len(warmImages) == 0 {
+		return
+	}
+	warmImagesTotal.Store(int64(len(warmImages)))
+	go func() {
+		select {
+		case <-dockerConnected:
+		case <-ctx.Done():
+			return
+		}
+		slog.InfoContext(ctx, "Prefetching warm images", "count", len(warmImages), "concurrency", warmConcurrency)
+		startTime := time.Now()
+		failed := PrefetchImages(ctx, warmImages, warmConcurrency, func(result PrefetchResult) {
+			warmImagesDone.Add(1)
+			if result.Err != nil {
+				slog.WarnContext(ctx, "Error prefetching image", "prefetch", result.Reference, "duration", result.Duration, "error", result.Err)
+			} else {
+				slog.InfoContext(ctx, "Prefetched image", "prefetch", result.Reference, "duration", result.Duration)
+			}
+		})
+		slog.InfoContext(ctx, "Finished prefetching warm images", "count", len(warmImages), "failed", failed, "duration", time.Since(startTime))
+	}()
+}
+
+// matchesLocalImagesFilter reports whether a Docker image reference like
+// "myorg/app:dev" matches the local images filter, if there is one.
+func matchesLocalImagesFilter(ref string, localImagesFilter []*regexp.Regexp) bool {
+	if len(localImagesFilter) == 0 {
+		return true
+	}
+	for _, pattern := range localImagesFilter {
+		if pattern.MatchString(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportAllLocalImages exports every tagged image that Docker has locally into
+// the cache in the background once Docker is reachable, so the first request for
+// them doesn't have to wait on the export. Images already in the cache are skipped.
+func exportAllLocalImages(ctx context.Context, dockerConnected <-chan struct{}) {
+	cfg := currentConfig()
+	if !cfg.ExportLocalImages {
+		return
+	}
+	go func() {
+		select {
+		case <-dockerConnected:
+		case <-ctx.Done():
+			return
+		}
+		tags, err := DockerImageListTags(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error listing local Docker images", "error", err)
+			return
+		}
+		refs := []string{}
+		for _, tag := range tags {
+			if matchesLocalImagesFilter(tag, cfg.LocalImagesFilter) {
+				refs = append(refs, tag)
+			}
+		}
+		slog.InfoContext(ctx, "Exporting local Docker images", "count", len(refs), "concurrency", cfg.WarmConcurrency)
+		startTime := time.Now()
+		failed := PrefetchImages(ctx, refs, cfg.WarmConcurrency, func(result PrefetchResult) {
+			if result.Err != nil {
+				slog.WarnContext(ctx, "Error exporting local image", "prefetch", result.Reference, "duration", result.Duration, "error", result.Err)
+			} else {
+				slog.DebugContext(ctx, "Exported local image", "prefetch", result.Reference, "duration", result.Duration)
+			}
+		})
+		slog.InfoContext(ctx, "Finished exporting local Docker images", "count", len(refs), "failed", failed, "duration", time.Since(startTime))
+	}()
+}
+
+func checkWarmImages() healthCheck {
+	total, done := warmImagesTotal.Load(), warmImagesDone.Load()
+	return healthCheck{done >= total, fmt.Sprintf("%d of %d warm images prefetched", done, total)}
+}
+
+// runPrefetch runs "prefetch <ref>...", which gets images into the cache without
+// running the registry.
+func runPrefetch(args []string) int {
+	flags := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	flags.StringVar(&CACHE_DIRECTORY, "cache-dir", CACHE_DIRECTORY, "Directory to cache exported images in")
+	cfg := defaultConfig()
+	concurrency := flags.Int("concurrency", cfg.WarmConcurrency, "Number of images to pull and export at once")
+	flags.DurationVar(&cfg.PullTimeout, "pull-timeout", cfg.PullTimeout, "Maximum time to spend pulling and exporting a single image")
+	var manifestPaths []string
+	flags.Func("f", "Also prefetch the images used by Kubernetes objects in a YAML `file`, a directory of YAML files, or stdin if \"-\". May be given multiple times", func(value string) error {
+		manifestPaths = append(manifestPaths, value)
+		return nil
+	})
+	dryRun := flags.Bool("dry-run", false, "Only print the images that would be prefetched")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: k3d-registry-dockerd prefetch [flags] [<ref>...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 && len(manifestPaths) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	activeConfig.Store(cfg)
+
+	refs := flags.Args()
+	for _, path := range manifestPaths {
+		images, err := ImagesFromManifestPath(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		refs = append(refs, images...)
+	}
+	images, err := normalizeImageList(refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *dryRun {
+		for _, image := range images {
+			fmt.Println(image)
+		}
+		return 0
+	}
+
+	failed := PrefetchImages(context.Background(), images, *concurrency, func(result PrefetchResult) {
+		if result.Err != nil {
+			fmt.Printf("FAILED  %s: %s\n", result.Reference, result.Err)
+		} else {
+			fmt.Printf("OK      %s (%s)\n", result.Reference, result.Duration.Round(time.Millisecond))
+		}
+	})
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d images failed\n", failed, len(images))
+		return 1
+	}
+	return 0
+}
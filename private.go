@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long to trust credentials that the upstream registry accepted for a
+// private image before asking it again
+const privateAuthTTL = 10 * time.Minute
+
+// cachedPrivateFilename marks an image repository which needed credentials to
+// pull. It holds the reference that was pulled, to check clients' credentials
+// against.
+func cachedPrivateFilename(imageName string) string {
+	return fmt.Sprint(cachedImageDirectory(imageName), "/private")
+}
+
+// cachedPrivateReference returns the reference a private image was pulled as, or
+// "" if the image isn't private.
+func cachedPrivateReference(imageName string) (string, error) {
+	content, err := os.ReadFile(cachedPrivateFilename(imageName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+// isPrivateImage reports whether an image was marked as private, treating
+// images that can't be checked as private.
+func isPrivateImage(imageName string) bool {
+	reference, err := cachedPrivateReference(imageName)
+	return err != nil || reference != ""
+}
+
+// references checked for whether they're private since the server started, so
+// that cache entries from before images were marked are only checked once
+var checkedPrivateImages sync.Map
+
+// pulledFromUpstream reports whether Docker got an image from its registry, rather
+// than it only being built or tagged locally, going by the image's repo digests.
+// Images which aren't in Docker anymore can't be told apart, so count as pulled.
+func pulledFromUpstream(ctx context.Context, imageName, reference string) (bool, error) {
+	image, err := DockerImageInspect(ctx, reference)
+	if err != nil || image == nil {
+		return image == nil, err
+	}
+	for _, repoDigest := range image.RepoDigests {
+		name, _, err := ParseImageReference(repoDigest)
+		if err == nil && name == imageName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkImageIfPrivate marks an image as private if the upstream registry doesn't
+// let anonymous clients pull it, so that it's only served to clients with
+// credentials for it. Images which Docker didn't pull from the upstream registry,
+// like locally-built images, aren't checked, and neither are images the
+// registry's own credentials can pull, since those are served to everyone. If the
+// upstream registry can't be asked, it returns an error and the image mustn't be
+// served until it's checked again.
+func checkImageIfPrivate(ctx context.Context, imageName, reference string) error {
+	if _, checked := checkedPrivateImages.Load(reference); checked {
+		return nil
+	}
+	upstream, err := pulledFromUpstream(ctx, imageName, reference)
+	if err != nil {
+		return fmt.Errorf("couldn't check whether image needs credentials: %w", err)
+	}
+	if !upstream {
+		checkedPrivateImages.Store(reference, true)
+		return nil
+	}
+	_, err = DockerDistributionInspect(ctx, reference, nil)
+	if err == nil {
+		checkedPrivateImages.Store(reference, true)
+		return nil
+	}
+	if !IsUnauthorizedError(err) {
+		return fmt.Errorf("couldn't check whether image needs credentials: %w", err)
+	}
+	domain, _, _ := strings.Cut(imageName, "/")
+	if auth := fallbackAuth(ctx, domain); auth != nil {
+		if _, err := DockerDistributionInspect(ctx, reference, auth); err == nil {
+			checkedPrivateImages.Store(reference, true)
+			return nil
+		}
+	}
+	slog.InfoContext(ctx, "Marking image as private, only clients with credentials for it will be served it")
+	_, err = copyToFile(cachedPrivateFilename(imageName), strings.NewReader(reference+"\n"))
+	if err != nil {
+		return err
+	}
+	checkedPrivateImages.Store(reference, true)
+	return nil
+}
+
+// credentials which the upstream registry accepted for private images, by image
+// and a hash of the credentials, with when they expire
+var privateAuthCache sync.Map
+
+// checkPrivateImageAuth makes sure that a client asking for a private image has
+// credentials for it which the upstream registry accepts, and otherwise responds
+// with 401 Unauthorized and returns false. When the registry has its own
+// authentication, clients' credentials aren't for the upstream registry, so it
+// decides who can pull what instead.
+//
+// Images cached before they were marked, or exported before the server started,
+// are checked the first time any client asks for them by tag or digest.
+func checkPrivateImageAuth(w http.ResponseWriter, req *http.Request, imageName, domain, tagOrDigest string) bool {
+	if currentConfig().registryAuthEnabled() {
+		return true
+	}
+	ctx := WithLogAttrs(req.Context(), "image", imageName)
+
+	reference, err := cachedPrivateReference(imageName)
+	if err == nil && reference == "" && tagOrDigest != "" {
+		var cached bool
+		cached, err = fileExists(cachedIndexFilename(imageName, tagOrDigest))
+		if err == nil && cached {
+			err = checkImageIfPrivate(ctx, imageName, dockerImageReference(imageName, tagOrDigest))
+			if err != nil {
+				slog.WarnContext(ctx, "Not serving image until it's known whether it's private", "error", err)
+				http.Error(w, fmt.Sprint(err), http.StatusBadGateway)
+				return false
+			}
+			reference, err = cachedPrivateReference(imageName)
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return false
+	}
+	if reference == "" {
+		return true
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		slog.InfoContext(ctx, "Client has no credentials for private image")
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", domain))
+		http.Error(w, "credentials are required for this image", http.StatusUnauthorized)
+		return false
+	}
+	authsum := sha256.Sum256([]byte(fmt.Sprint(username, ":", password)))
+	key := fmt.Sprint(imageName, " ", hex.EncodeToString(authsum[:]))
+	if expires, ok := privateAuthCache.Load(key); ok && time.Now().Before(expires.(time.Time)) {
+		return true
+	}
+
+	// the upstream registry has the final say on whether credentials are valid
+	_, err = DockerDistributionInspect(ctx, reference, &ImageAuthConfig{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		slog.InfoContext(ctx, "Upstream registry didn't accept client's credentials for private image", "username", username, "error", err)
+		if IsUnauthorizedError(err) {
+			http.Error(w, "credentials aren't valid for this image", http.StatusUnauthorized)
+		} else {
+			http.Error(w, fmt.Sprintf("couldn't check credentials for this image: %s", err), http.StatusBadGateway)
+		}
+		return false
+	}
+	privateAuthCache.Store(key, time.Now().Add(privateAuthTTL))
+	return true
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TagPolicy decides how long a cached tag can be served before checking whether
+// it has moved upstream.
+type TagPolicy struct {
+	// Pattern matched against domain/name:tag, where "*" matches anything
+	Pattern string
+	// Immutable tags are never revalidated
+	Immutable bool
+	// Mutable tags are revalidated once they're older than RevalidateAfter, so
+	// zero means they're revalidated every time
+	RevalidateAfter time.Duration
+
+	pattern *regexp.Regexp
+}
+
+func ParseTagPolicy(value string) (TagPolicy, error) {
+	pattern, policy, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" {
+		return TagPolicy{}, fmt.Errorf("tag policy %q should look like pattern=policy", value)
+	}
+
+	result := TagPolicy{
+		Pattern: pattern,
+		pattern: globRegexp(pattern),
+	}
+
+	switch policy {
+	case "immutable":
+		result.Immutable = true
+	case "always":
+		result.RevalidateAfter = 0
+	default:
+		d, err := time.ParseDuration(policy)
+		if err != nil || d < 0 {
+			return TagPolicy{}, fmt.Errorf("tag policy %q should be \"immutable\", \"always\", or a duration", policy)
+		}
+		result.RevalidateAfter = d
+	}
+	return result, nil
+}
+
+// globRegexp compiles a pattern where "*" matches anything, including slashes,
+// and everything else is matched literally.
+func globRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func (policy TagPolicy) Matches(imageName, imageTag string) bool {
+	return policy.pattern.MatchString(fmt.Sprint(imageName, ":", imageTag))
+}
+
+func (policy TagPolicy) String() string {
+	switch {
+	case policy.Immutable:
+		return fmt.Sprint(policy.Pattern, "=immutable")
+	case policy.RevalidateAfter == 0:
+		return fmt.Sprint(policy.Pattern, "=always")
+	default:
+		return fmt.Sprint(policy.Pattern, "=", policy.RevalidateAfter)
+	}
+}
+
+// TagPolicies is a list of policies where the first matching policy wins. It can
+// be used with flag.Var to build the list from repeated command line flags.
+type TagPolicies []TagPolicy
+
+func (policies *TagPolicies) Set(value string) error {
+	policy, err := ParseTagPolicy(value)
+	if err != nil {
+		return err
+	}
+	*policies = append(*policies, policy)
+	return nil
+}
+
+func (policies *TagPolicies) String() string {
+	if policies == nil {
+		return ""
+	}
+	values := make([]string, len(*policies))
+	for i, policy := range *policies {
+		values[i] = policy.String()
+	}
+	return strings.Join(values, ",")
+}
+
+func (policies TagPolicies) PolicyFor(imageName, imageTag string) TagPolicy {
+	for _, policy := range policies {
+		if policy.Matches(imageName, imageTag) {
+			return policy
+		}
+	}
+	// cached tags have always been immutable, so keep that as the default
+	return TagPolicy{Pattern: "*", Immutable: true}
+}
+
+// how long to wait on the upstream registry before serving a stale tag
+const revalidateTimeout = 10 * time.Second
+
+// tags being revalidated in the background because the upstream registry couldn't
+// be reached
+var backgroundRevalidations sync.Map
+
+func revalidateCachedTagIfStale(ctx context.Context, imageName, imageTag string, auth *ImageAuthConfig) {
+	policy := currentConfig().TagPolicies.PolicyFor(imageName, imageTag)
+	if policy.Immutable {
+		return
+	}
+	lastValidated, err := lastRevalidatedTime(imageName, imageTag)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking when tag was last revalidated", "error", err)
+		return
+	}
+	if time.Since(lastValidated) < policy.RevalidateAfter {
+		return
+	}
+
+	key := fmt.Sprint(imageName, " ", imageTag)
+	if _, ok := backgroundRevalidations.Load(key); ok {
+		slog.InfoContext(ctx, "Serving stale tag while it's revalidated in the background")
+		return
+	}
+
+	slog.InfoContext(ctx, "Revalidating tag", "tag_policy", policy.String())
+	err = revalidateCachedTag(ctx, imageName, imageTag, auth)
+	if err != nil {
+		slog.WarnContext(ctx, "Error revalidating tag, serving stale image and retrying in the background", "error", err)
+		revalidateCachedTagInBackground(key, imageName, imageTag, auth)
+	}
+}
+
+func revalidateCachedTagInBackground(key, imageName, imageTag string, auth *ImageAuthConfig) {
+	if _, loaded := backgroundRevalidations.LoadOrStore(key, true); loaded {
+		return
+	}
+	go func() {
+		defer backgroundRevalidations.Delete(key)
+		ctx, cancel := context.WithTimeout(serverContext, currentConfig().PullTimeout)
+		defer cancel()
+		ctx = WithLogAttrs(ctx, "image", imageName, "reference", imageTag)
+
+		delay := 15 * time.Second
+		for {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				slog.WarnContext(ctx, "Gave up revalidating tag in the background", "reason", ctx.Err())
+				return
+			}
+			_, err := withCacheLock(ctx, imageName, imageTag, func() (any, error) {
+				return nil, revalidateCachedTag(ctx, imageName, imageTag, auth)
+			})
+			if err == nil {
+				return
+			}
+			slog.WarnContext(ctx, "Error revalidating tag in the background", "error", err)
+			delay = min(delay*2, 5*time.Minute)
+		}
+	}()
+}
+
+// recordUpstreamDigest remembers the digest a tag pointed to upstream when it was
+// exported. Without Docker's containerd image store, the exported digests differ
+// from the upstream registry's, so otherwise the first revalidation would always
+// pull the tag again. Locally-built images aren't upstream, and are left alone.
+func recordUpstreamDigest(ctx context.Context, imageName, imageTag string, auth *ImageAuthConfig) {
+	if currentConfig().TagPolicies.PolicyFor(imageName, imageTag).Immutable {
+		return
+	}
+	inspectCtx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+	inspectCtx, span := startSpan(inspectCtx, "docker distribution inspect")
+	upstreamDigest, err := DockerDistributionInspect(inspectCtx, dockerImageReference(imageName, imageTag), auth)
+	endSpan(span, err)
+	if err != nil {
+		slog.DebugContext(ctx, "Couldn't find tag upstream, not recording its digest", "error", err)
+		return
+	}
+	_, err = copyToFile(cachedRevalidatedFilename(imageName, imageTag), strings.NewReader(upstreamDigest))
+	if err != nil {
+		slog.WarnContext(ctx, "Error recording upstream digest of tag", "error", err)
+	}
+}
+
+func lastRevalidatedTime(imageName, imageTag string) (time.Time, error) {
+	// tags are revalidated when first exported, and then whenever the revalidated
+	// file gets written.
+	info, err := os.Stat(cachedRevalidatedFilename(imageName, imageTag))
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = os.Stat(cachedIndexFilename(imageName, imageTag))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func revalidateCachedTag(ctx context.Context, imageName, imageTag string, auth *ImageAuthConfig) (err error) {
+	fullName := dockerImageReference(imageName, imageTag)
+	ctx, span := startSpan(ctx, "revalidate tag",
+		attribute.String("image", imageName), attribute.String("reference", imageTag))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx, done := StartJob(ctx, imageName, imageTag)
+	defer done()
+	SetJobStage(ctx, "revalidating")
+
+	// ask the upstream registry where the tag points now, which doesn't need a pull
+	inspectCtx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+	inspectCtx, inspectSpan := startSpan(inspectCtx, "docker distribution inspect")
+	upstreamDigest, err := DockerDistributionInspect(inspectCtx, fullName, auth)
+	endSpan(inspectSpan, err)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("upstream_digest", upstreamDigest))
+
+	// the cached index points at the same digest when using Docker's containerd
+	// image store. otherwise, Docker exports different digests than the upstream
+	// registry, so also remember the upstream digest we last revalidated against.
+	index, err := ParseIndexFile(cachedIndexFilename(imageName, imageTag))
+	if err != nil {
+		return err
+	}
+	lastDigest, err := os.ReadFile(cachedRevalidatedFilename(imageName, imageTag))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	upToDate := string(lastDigest) == upstreamDigest
+	for _, m := range index.Manifests {
+		upToDate = upToDate || m.Digest.String() == upstreamDigest
+	}
+
+	if !upToDate {
+		slog.InfoContext(ctx, "Tag has moved upstream, pulling it again", "upstream_digest", upstreamDigest)
+		SetJobStage(ctx, "pulling")
+		startTime := time.Now()
+		pullCtx, pullSpan := startSpan(ctx, "docker image pull")
+		found, err := DockerImagePull(pullCtx, fullName, auth, func(statusMessage string) {
+			slog.DebugContext(ctx, statusMessage)
+			SetJobProgress(ctx, statusMessage)
+		})
+		endSpan(pullSpan, err)
+		observeDockerOperation("pull", startTime, err)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("couldn't find Docker image %s", fullName)
+		}
+		found, err = findAndExportImage(ctx, imageName, imageTag, auth)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("couldn't export Docker image %s", fullName)
+		}
+	} else {
+		slog.InfoContext(ctx, "Tag is up to date", "upstream_digest", upstreamDigest)
+	}
+
+	_, err = copyToFile(cachedRevalidatedFilename(imageName, imageTag), strings.NewReader(upstreamDigest))
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copyToFile writes to temp files named like this next to the file being
+// written, so that they can be found and removed if they're left behind.
+const tempFilePattern = ".tmp-*"
+
+// temp files being written by this process, which are removed when shutting down
+// in case the write never finished.
+var tempFiles sync.Map
+
+func isTempFile(filename string) bool {
+	return strings.Contains(filepath.Base(filename), ".tmp-")
+}
+
+// removeTempFiles removes the temp files this process is still writing.
+func removeTempFiles(ctx context.Context) {
+	tempFiles.Range(func(key, _ any) bool {
+		filename := key.(string)
+		err := os.Remove(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "Error removing temp file", "path", filename, "error", err)
+		} else if err == nil {
+			slog.InfoContext(ctx, "Removed unfinished temp file", "path", filename)
+		}
+		tempFiles.Delete(filename)
+		return true
+	})
+}
+
+// removeStaleTempFiles removes temp files in the cache directory left behind by
+// a process which was killed while writing them. Other processes may share the
+// cache directory, so only files which haven't been written to for a while are
+// removed.
+func removeStaleTempFiles(ctx context.Context, directory string, minAge time.Duration) {
+	err := filepath.WalkDir(directory, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isTempFile(filename) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < minAge {
+			return nil
+		}
+		err = os.Remove(filename)
+		if err != nil {
+			slog.WarnContext(ctx, "Error removing stale temp file", "path", filename, "error", err)
+		} else {
+			slog.InfoContext(ctx, "Removed stale temp file", "path", filename)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.WarnContext(ctx, "Error looking for stale temp files", "error", err)
+	}
+}
+
+// how long to wait for exports to unwind after cancelling them
+const exportCancelGracePeriod = 2 * time.Second
+
+// waitForExports waits until no exports are running, or ctx is done.
+func waitForExports(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for imageExportPool.Stats().Running > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// shutdownServer stops accepting connections, and waits up to the shutdown
+// timeout for requests in progress, like blobs being streamed, and pulls and
+// exports to finish. Anything still running after that is cancelled, and the
+// temp files it was writing are removed.
+func shutdownServer(server *http.Server) {
+	ctx := context.Background()
+	timeout := currentConfig().ShutdownTimeout
+	slog.InfoContext(ctx, "Shutting down, waiting for requests and exports in progress", "timeout", timeout)
+	startTime := time.Now()
+	deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := server.Shutdown(deadlineCtx)
+	if err != nil {
+		slog.WarnContext(ctx, "Requests still in progress at shutdown deadline, closing them", "error", err)
+		server.Close()
+	}
+	if !waitForExports(deadlineCtx) {
+		slog.WarnContext(ctx, "Exports still in progress at shutdown deadline, cancelling them", "running", imageExportPool.Stats().Running)
+	}
+
+	cancelServerContext()
+	graceCtx, cancelGrace := context.WithTimeout(ctx, exportCancelGracePeriod)
+	defer cancelGrace()
+	waitForExports(graceCtx)
+	removeTempFiles(ctx)
+	slog.InfoContext(ctx, "Shut down", "duration", time.Since(startTime))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"ago":   formatAgo,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>k3d-registry-dockerd</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+td.number { text-align: right; }
+code { font-size: 0.9em; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>k3d-registry-dockerd</h1>
+
+<h2>Docker</h2>
+{{with .DockerError}}<p>Error connecting to Docker: {{.}}</p>{{end}}
+<table>
+<tr><th>Daemon host</th><td>{{.Docker.DaemonHost}}</td></tr>
+<tr><th>API version</th><td>{{.Docker.ApiVersion}}</td></tr>
+<tr><th>Server version</th><td>{{.Docker.ServerVersion}}</td></tr>
+<tr><th>Server OS/architecture</th><td>{{.Docker.ServerOSType}}/{{.Docker.ServerArchitecture}}</td></tr>
+</table>
+
+<h2>In progress</h2>
+{{if .Jobs}}
+<table>
+<tr><th>Image</th><th>Stage</th><th>Started</th><th>Progress</th></tr>
+{{range .Jobs}}
+<tr><td>{{.Image}}:{{.Reference}}</td><td>{{.Stage}}</td><td>{{ago .Started}}</td><td><code>{{.Progress}}</code></td></tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">Nothing is being pulled or exported.</p>
+{{end}}
+
+<h2>Cached images</h2>
+{{with .CacheError}}<p>Error reading cache: {{.}}</p>{{end}}
+{{if .Images}}
+<table>
+<tr><th>Image</th><th>Tag</th><th>Digest</th><th>Size</th><th>Exported</th><th>Last served</th></tr>
+{{range .Images}}
+<tr><th colspan="3">{{.Name}}</th><td class="number">{{bytes .Size}}</td><td colspan="2" class="muted">{{.Blobs}} blobs</td></tr>
+{{range .Tags}}
+<tr><td></td><td>{{.Tag}}</td><td><code>{{.Digest}}</code></td><td class="number">{{bytes .Size}}</td><td>{{ago .Exported}}</td><td>{{with .LastAccess}}{{ago .}}{{else}}never{{end}}</td></tr>
+{{end}}
+{{end}}
+</table>
+{{else}}
+<p class="muted">The cache is empty.</p>
+{{end}}
+
+<h2>Recent warnings and errors</h2>
+{{if .Errors}}
+<table>
+<tr><th>Time</th><th>Level</th><th>Message</th></tr>
+{{range .Errors}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Level}}</td><td>{{.Message}}<br><code class="muted">{{.Attrs}}</code></td></tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">Nothing has gone wrong yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+type statusPage struct {
+	Docker      DockerInfo
+	DockerError error
+	Jobs        []JobStatus
+	Images      []CachedImage
+	CacheError  error
+	Errors      []LogEntry
+}
+
+// handleStatusPage shows what's in the cache, what's being pulled and exported,
+// and anything that's gone wrong recently. Anyone can see it, so private images
+// are left out.
+func handleStatusPage(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+
+	var page statusPage
+	page.Docker, page.DockerError = DockerGetInfo(ctx)
+	for _, job := range ActiveJobs() {
+		if !isPrivateImage(job.Image) {
+			page.Jobs = append(page.Jobs, job)
+		}
+	}
+	images, err := ListCachedImages()
+	page.CacheError = err
+	for _, image := range images {
+		if !image.Private {
+			page.Images = append(page.Images, image)
+		}
+	}
+	for _, entry := range recentErrors.Entries() {
+		if entry.Image == "" || !isPrivateImage(entry.Image) {
+			page.Errors = append(page.Errors, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = statusPageTemplate.Execute(w, page)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error rendering status page", "error", err)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprint(n, " B")
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAgo(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprint(time.Since(t).Truncate(time.Second), " ago")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GeneratedTLS is where the generated certificates are kept, in the cache
+// directory so that they survive restarts and clients only need to trust the
+// CA once.
+type GeneratedTLS struct {
+	CACertificate string
+	CAKey         string
+	Certificate   string
+	Key           string
+}
+
+func generatedTLSPaths() GeneratedTLS {
+	directory := filepath.Join(CACHE_DIRECTORY, ".tls")
+	return GeneratedTLS{
+		CACertificate: filepath.Join(directory, "ca.crt"),
+		CAKey:         filepath.Join(directory, "ca.key"),
+		Certificate:   filepath.Join(directory, "server.crt"),
+		Key:           filepath.Join(directory, "server.key"),
+	}
+}
+
+// server certificates are renewed when they're this close to expiring
+const certificateRenewBefore = 30 * 24 * time.Hour
+
+// defaultTLSHosts are the names the generated certificate is always valid for.
+func defaultTLSHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// EnsureGeneratedCertificate creates a self-signed CA and a server certificate
+// signed by it for hosts, unless they already exist. The CA is kept as long as
+// it's valid, and the server certificate is replaced if it's about to expire or
+// doesn't cover every host. It returns whether anything was generated.
+func EnsureGeneratedCertificate(hosts []string) (GeneratedTLS, bool, error) {
+	paths := generatedTLSPaths()
+	err := os.MkdirAll(filepath.Dir(paths.CACertificate), 0755)
+	if err != nil {
+		return paths, false, err
+	}
+
+	generated := false
+	ca, caKey, err := loadCertificate(paths.CACertificate, paths.CAKey)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && time.Until(ca.NotAfter) < certificateRenewBefore) {
+		ca, caKey, err = generateCertificate(paths.CACertificate, paths.CAKey, nil, nil, nil)
+		generated = true
+	}
+	if err != nil {
+		return paths, false, fmt.Errorf("error loading CA: %w", err)
+	}
+
+	cert, _, err := loadCertificate(paths.Certificate, paths.Key)
+	if err == nil && !generated && certificateCovers(cert, ca, hosts) {
+		return paths, false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return paths, false, fmt.Errorf("error loading server certificate: %w", err)
+	}
+	_, _, err = generateCertificate(paths.Certificate, paths.Key, hosts, ca, caKey)
+	if err != nil {
+		return paths, false, fmt.Errorf("error generating server certificate: %w", err)
+	}
+	return paths, true, nil
+}
+
+// certificateCovers reports whether cert was issued by ca, isn't about to
+// expire, and is valid for every host.
+func certificateCovers(cert, ca *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(ca) != nil || time.Until(cert.NotAfter) < certificateRenewBefore {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func loadCertificate(certPath, keyPath string) (*x509.Certificate, any, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pair.PrivateKey, nil
+}
+
+// generateCertificate writes a new key and certificate. Without a parent it's a
+// CA, and otherwise a server certificate for hosts signed by the parent.
+func generateCertificate(certPath, keyPath string, hosts []string, parent *x509.Certificate, parentKey any) (*x509.Certificate, any, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+	}
+	if parent == nil {
+		template.Subject = pkix.Name{CommonName: "k3d-registry-dockerd CA"}
+		template.NotAfter = time.Now().AddDate(10, 0, 0)
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		parent, parentKey = template, key
+	} else {
+		template.Subject = pkix.Name{CommonName: hosts[0]}
+		// the longest validity that Apple platforms accept
+		template.NotAfter = time.Now().AddDate(0, 0, 825)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
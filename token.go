@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the service name clients ask the token service for, and which tokens are for
+const tokenService = "k3d-registry-dockerd"
+
+// how long tokens are valid for. clients get a new one when it expires.
+const tokenExpiry = 5 * time.Minute
+
+// AccessRule grants a user actions on the repositories matching a pattern.
+type AccessRule struct {
+	// User is a user from the htpasswd file, "*" for any of them, or "anonymous"
+	// for clients which haven't logged in
+	User string
+	// Pattern matched against the repository name, where "*" matches anything
+	Pattern string
+	// Actions are any of "pull", "push", and "delete", or "*" for all of them
+	Actions []string
+
+	pattern *regexp.Regexp
+}
+
+func ParseAccessRule(value string) (AccessRule, error) {
+	userPattern, actions, ok := strings.Cut(value, "=")
+	user, pattern, ok2 := strings.Cut(userPattern, ":")
+	if !ok || !ok2 || user == "" || pattern == "" {
+		return AccessRule{}, fmt.Errorf("access rule %q should look like user:pattern=actions", value)
+	}
+	result := AccessRule{
+		User:    user,
+		Pattern: pattern,
+		pattern: globRegexp(pattern),
+	}
+	for _, action := range strings.Split(actions, ",") {
+		switch action {
+		case "pull", "push", "delete":
+			result.Actions = append(result.Actions, action)
+		case "*":
+			result.Actions = append(result.Actions, "pull", "push", "delete")
+		case "":
+		default:
+			return AccessRule{}, fmt.Errorf("unknown action %q in access rule %q, should be pull, push, delete, or *", action, value)
+		}
+	}
+	return result, nil
+}
+
+func (rule AccessRule) Matches(user, repository string) bool {
+	switch rule.User {
+	case "anonymous":
+		if user != "" {
+			return false
+		}
+	case "*":
+		if user == "" {
+			return false
+		}
+	default:
+		if rule.User != user {
+			return false
+		}
+	}
+	return rule.pattern.MatchString(repository)
+}
+
+func (rule AccessRule) String() string {
+	return fmt.Sprint(rule.User, ":", rule.Pattern, "=", strings.Join(rule.Actions, ","))
+}
+
+// AccessRules is a list of rules where the first matching rule wins. It can be
+// used with flag.Var to build the list from repeated command line flags.
+type AccessRules []AccessRule
+
+func (rules *AccessRules) Set(value string) error {
+	rule, err := ParseAccessRule(value)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+func (rules *AccessRules) String() string {
+	if rules == nil {
+		return ""
+	}
+	values := make([]string, len(*rules))
+	for i, rule := range *rules {
+		values[i] = rule.String()
+	}
+	return strings.Join(values, ",")
+}
+
+// ActionsFor returns the actions a user, or "" if anonymous, may take on a
+// repository.
+func (rules AccessRules) ActionsFor(user, repository string) []string {
+	if len(rules) == 0 {
+		// without any rules, everyone who has logged in can do anything
+		if user == "" {
+			return nil
+		}
+		return []string{"pull", "push", "delete"}
+	}
+	for _, rule := range rules {
+		if rule.Matches(user, repository) {
+			return rule.Actions
+		}
+	}
+	return nil
+}
+
+// tokenAccess is a scope granted by a token, in the format of the Docker token
+// authentication spec.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  string        `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat"`
+	ID        string        `json:"jti"`
+	Access    []tokenAccess `json:"access"`
+}
+
+// parseScope parses the scope parameter of a token request, like
+// "repository:myorg/app:pull,push". Other kinds of scope are ignored.
+func parseScope(scope string) (tokenAccess, bool) {
+	scopeType, rest, ok := strings.Cut(scope, ":")
+	// repository names may contain colons when they have a port, so the actions
+	// are after the last one
+	i := strings.LastIndex(rest, ":")
+	if !ok || scopeType != "repository" || i < 0 {
+		return tokenAccess{}, false
+	}
+	return tokenAccess{scopeType, rest[:i], strings.Split(rest[i+1:], ",")}, true
+}
+
+// scopeRepository returns the name that the repository of a token request's scope
+// is cached as, which access rules are matched against. Clients like the Docker
+// CLI ask for the path they pulled or pushed rather than the scope in the
+// challenge, and these only differ by the proxy remote URL's domain.
+func scopeRepository(name, proxyDomain string) string {
+	if proxyDomain == "" || strings.HasPrefix(name, proxyDomain+"/") {
+		return name
+	}
+	return fmt.Sprint(proxyDomain, "/", name)
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func signToken(key []byte, claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := fmt.Sprint(jwtHeader, ".", base64.RawURLEncoding.EncodeToString(payload))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return fmt.Sprint(unsigned, ".", base64.RawURLEncoding.EncodeToString(mac.Sum(nil))), nil
+}
+
+// verifyToken checks that a token was signed with key and hasn't expired, and
+// returns its claims.
+func verifyToken(key []byte, token string) (tokenClaims, error) {
+	var claims tokenClaims
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || header != jwtHeader {
+		return claims, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprint(header, ".", payload)))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return claims, errors.New("invalid token signature")
+	}
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, err
+	}
+	err = json.Unmarshal(content, &claims)
+	if err != nil {
+		return claims, err
+	}
+	now := time.Now().Unix()
+	if claims.Audience != tokenService || now >= claims.ExpiresAt || now < claims.NotBefore {
+		return claims, errors.New("token has expired or isn't for this registry")
+	}
+	return claims, nil
+}
+
+// grants reports whether the claims allow an action on a repository.
+func (claims tokenClaims) grants(repository, action string) bool {
+	for _, access := range claims.Access {
+		if access.Type == "repository" && access.Name == repository && slices.Contains(access.Actions, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrCreateTokenKey reads the key tokens are signed with from the cache
+// directory, generating it the first time, so that tokens stay valid across
+// restarts and between registries sharing the cache directory.
+func loadOrCreateTokenKey(cacheDir string) ([]byte, error) {
+	path := filepath.Join(cacheDir, ".token-key")
+	content, err := os.ReadFile(path)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(content)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(cacheDir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600)
+}
+
+// tokenRealm is the URL of the token service, as seen by the client.
+func tokenRealm(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprint(scheme, "://", req.Host, "/token")
+}
+
+// handleToken issues tokens to clients following the Docker token authentication
+// flow. Clients log in with a user from the htpasswd file, or don't to get the
+// access of anonymous users, and get whichever of the actions they asked for in
+// each scope that the access rules allow.
+func handleToken(w http.ResponseWriter, req *http.Request) {
+	cfg := currentConfig()
+	if !cfg.TokenAuth {
+		http.NotFound(w, req)
+		return
+	}
+
+	user := ""
+	if username, password, ok := req.BasicAuth(); ok && cfg.htpasswd != nil {
+		if !checkHtpasswd(cfg, username, password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", cfg.HtpasswdRealm))
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "incorrect username or password")
+			return
+		}
+		user = username
+	}
+
+	access := []tokenAccess{}
+	for _, scope := range req.URL.Query()["scope"] {
+		for _, scope := range strings.Split(scope, " ") {
+			requested, ok := parseScope(scope)
+			if !ok {
+				continue
+			}
+			allowed := cfg.AccessRules.ActionsFor(user, scopeRepository(requested.Name, cfg.proxyDomain))
+			granted := []string{}
+			for _, action := range requested.Actions {
+				if slices.Contains(allowed, action) && !slices.Contains(granted, action) {
+					granted = append(granted, action)
+				}
+			}
+			access = append(access, tokenAccess{requested.Type, requested.Name, granted})
+		}
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := time.Now()
+	token, err := signToken(cfg.tokenKey, tokenClaims{
+		Issuer:    tokenService,
+		Subject:   user,
+		Audience:  tokenService,
+		ExpiresAt: now.Add(tokenExpiry).Unix(),
+		NotBefore: now.Add(-time.Minute).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        hex.EncodeToString(id),
+		Access:    access,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	slog.DebugContext(req.Context(), "Issued token", "user", user, "access", access)
+
+	content, err := json.Marshal(map[string]any{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(tokenExpiry.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(append(content, '\n'))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	valid := tokenClaims{
+		Issuer:    tokenService,
+		Audience:  tokenService,
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		NotBefore: now.Add(-time.Minute).Unix(),
+		Access:    []tokenAccess{{"repository", "myorg/app", []string{"pull"}}},
+	}
+	sign := func(key []byte, change func(*tokenClaims)) string {
+		claims := valid
+		change(&claims)
+		token, err := signToken(key, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	validToken := sign(key, func(*tokenClaims) {})
+	header, rest, _ := strings.Cut(validToken, ".")
+	payload, signature, _ := strings.Cut(rest, ".")
+	otherPayload := strings.Split(sign(key, func(c *tokenClaims) { c.Subject = "admin" }), ".")[1]
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", validToken, true},
+		{"wrong key", sign([]byte("other"), func(*tokenClaims) {}), false},
+		{"tampered payload", strings.Join([]string{header, otherPayload, signature}, "."), false},
+		{"missing signature", strings.Join([]string{header, payload}, "."), false},
+		{"empty signature", strings.Join([]string{header, payload, ""}, "."), false},
+		{"other algorithm", strings.Join([]string{"eyJhbGciOiJub25lIn0", payload, signature}, "."), false},
+		{"expired", sign(key, func(c *tokenClaims) { c.ExpiresAt = now.Add(-time.Second).Unix() }), false},
+		{"not yet valid", sign(key, func(c *tokenClaims) { c.NotBefore = now.Add(time.Minute).Unix() }), false},
+		{"other audience", sign(key, func(c *tokenClaims) { c.Audience = "other-registry" }), false},
+		{"garbage", "not a token", false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifyToken(key, test.token)
+			if test.ok && err != nil {
+				t.Fatalf("verifyToken() = %v, want no error", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("verifyToken() = %+v, want an error", claims)
+			}
+			if test.ok && !claims.grants("myorg/app", "pull") {
+				t.Errorf("claims don't grant pull on myorg/app: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  tokenAccess
+		ok    bool
+	}{
+		{"repository:myorg/app:pull", tokenAccess{"repository", "myorg/app", []string{"pull"}}, true},
+		{"repository:myorg/app:pull,push", tokenAccess{"repository", "myorg/app", []string{"pull", "push"}}, true},
+		{"repository:localhost:5000/app:push", tokenAccess{"repository", "localhost:5000/app", []string{"push"}}, true},
+		{"repository:registry.local:443/org/app:pull,delete", tokenAccess{"repository", "registry.local:443/org/app", []string{"pull", "delete"}}, true},
+		{"registry:catalog:*", tokenAccess{}, false},
+		{"repository:app", tokenAccess{}, false},
+		{"repository", tokenAccess{}, false},
+		{"", tokenAccess{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.scope, func(t *testing.T) {
+			got, ok := parseScope(test.scope)
+			if ok != test.ok {
+				t.Fatalf("parseScope(%q) ok = %v, want %v", test.scope, ok, test.ok)
+			}
+			if got.Type != test.want.Type || got.Name != test.want.Name || !slices.Equal(got.Actions, test.want.Actions) {
+				t.Errorf("parseScope(%q) = %+v, want %+v", test.scope, got, test.want)
+			}
+		})
+	}
+}
+
+func TestScopeRepository(t *testing.T) {
+	tests := []struct {
+		name, proxyDomain, want string
+	}{
+		{"myapp", "", "myapp"},
+		{"docker.io/myapp", "", "docker.io/myapp"},
+		{"myapp", "docker.io", "docker.io/myapp"},
+		{"docker.io/myapp", "docker.io", "docker.io/myapp"},
+		{"myorg/app", "registry.local:5000", "registry.local:5000/myorg/app"},
+	}
+	for _, test := range tests {
+		if got := scopeRepository(test.name, test.proxyDomain); got != test.want {
+			t.Errorf("scopeRepository(%q, %q) = %q, want %q", test.name, test.proxyDomain, got, test.want)
+		}
+	}
+}
+
+func TestAccessRulesActionsFor(t *testing.T) {
+	var rules AccessRules
+	for _, value := range []string{
+		"ci:*=*",
+		"anonymous:docker.io/public/*=pull",
+		"alice:docker.io/alice/*=pull,push",
+		"*:docker.io/alice/*=pull",
+		"*:*=pull",
+	} {
+		if err := rules.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user, repository string
+		want             []string
+	}{
+		{"ci", "docker.io/anything", []string{"pull", "push", "delete"}},
+		{"", "docker.io/public/app", []string{"pull"}},
+		{"", "docker.io/alice/app", nil},
+		{"alice", "docker.io/alice/app", []string{"pull", "push"}},
+		{"bob", "docker.io/alice/app", []string{"pull"}},
+		{"bob", "docker.io/public/app", []string{"pull"}},
+		// the first matching rule wins, even if a later one would allow more
+		{"ci", "docker.io/alice/app", []string{"pull", "push", "delete"}},
+		// patterns match the whole name
+		{"alice", "ghcr.io/docker.io/alice/app", []string{"pull"}},
+	}
+	for _, test := range tests {
+		if got := rules.ActionsFor(test.user, test.repository); !slices.Equal(got, test.want) {
+			t.Errorf("ActionsFor(%q, %q) = %v, want %v", test.user, test.repository, got, test.want)
+		}
+	}
+
+	var none AccessRules
+	if got := none.ActionsFor("", "docker.io/app"); got != nil {
+		t.Errorf("without rules, anonymous clients get %v, want nothing", got)
+	}
+	if got := none.ActionsFor("alice", "docker.io/app"); !slices.Equal(got, []string{"pull", "push", "delete"}) {
+		t.Errorf("without rules, users get %v, want everything", got)
+	}
+}
+
+func TestParseAccessRule(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"alice:myorg/*=pull,push", true},
+		{"anonymous:*=pull", true},
+		{"*:*=*", true},
+		{"alice:myorg/*=", true},
+		{"alice=pull", false},
+		{"alice:myorg/*", false},
+		{":myorg/*=pull", false},
+		{"alice:=pull", false},
+		{"alice:myorg/*=pull,admin", false},
+	}
+	for _, test := range tests {
+		_, err := ParseAccessRule(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseAccessRule(%q) = %v, want ok %v", test.value, err, test.ok)
+		}
+	}
+}